@@ -0,0 +1,56 @@
+package main
+
+import "flag"
+
+// CmdLineParams collects the command-line flags that configure a sybilhunter
+// uptime-analysis run.  Fields are added to it as the flags that populate
+// them are introduced elsewhere in the tool.
+type CmdLineParams struct {
+	// InputData points at the consensus data (directory or file) to
+	// analyse.
+	InputData string
+
+	// StoreDir is the directory holding the on-disk uptime store that
+	// AnalyseUptimes persists relay sequences to between runs.
+	StoreDir string
+
+	// Resolutions is a comma-separated multi-resolution band spec, e.g.
+	// "1h:7d,1d:60d,1w:all".  If set, AnalyseUptimes renders a composite,
+	// multi-resolution image instead of sybilhunter's original
+	// single-resolution one; see uptimestore.ParseResolutions.
+	Resolutions string
+
+	// Resume incrementally resumes a previous run via a curation.Curator
+	// instead of rebuilding the store from the full consensus stream.
+	Resume bool
+
+	// CurationDir is the directory holding the incremental curator's
+	// watermark and checksum files.  Only used when Resume is set.
+	CurationDir string
+
+	// LSHBits, LSHBands, and LSHThreshold tune the locality-sensitive
+	// hashing pass GetHighlights uses to find dispersed Sybil cohorts.
+	// Zero means "use uptimestore's default"; see lshParams.
+	LSHBits      int
+	LSHBands     int
+	LSHThreshold int
+}
+
+// ParseCmdLine registers and parses sybilhunter's uptime-analysis flags.
+func ParseCmdLine() *CmdLineParams {
+
+	params := &CmdLineParams{}
+
+	flag.StringVar(&params.InputData, "data", "", "Directory or file containing the consensus data to analyse.")
+	flag.StringVar(&params.StoreDir, "store", "uptime-store", "Directory holding the on-disk uptime store.")
+	flag.StringVar(&params.Resolutions, "resolutions", "", "Comma-separated multi-resolution bands, e.g. \"1h:7d,1d:60d,1w:all\"; renders a composite image instead of sybilhunter's original single-resolution one.")
+	flag.BoolVar(&params.Resume, "resume", false, "Incrementally resume a previous run instead of rebuilding the store from scratch.")
+	flag.StringVar(&params.CurationDir, "curation-dir", "uptime-curation", "Directory holding the incremental curator's watermark and checksums.")
+	flag.IntVar(&params.LSHBits, "lsh-bits", 0, "Number of bits in the LSH signature used for similarity grouping.  Zero uses uptimestore's default.")
+	flag.IntVar(&params.LSHBands, "lsh-bands", 0, "Number of LSH bands to slice the signature into.  Zero uses uptimestore's default.")
+	flag.IntVar(&params.LSHThreshold, "lsh-threshold", 0, "Minimum number of matching LSH bands before a candidate pair is verified.  Zero uses uptimestore's default.")
+
+	flag.Parse()
+
+	return params
+}
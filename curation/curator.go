@@ -0,0 +1,196 @@
+// Package curation runs sybilhunter's Sybil-detection passes incrementally,
+// inspired by Prometheus's batch sample curator: rather than ingesting an
+// entire consensus history and rendering once, a Curator remembers how much
+// of the stream it has already ingested and which relays changed since the
+// last pass, so an operator can run the tool hourly on fresh consensuses and
+// only redo the work the new data actually requires.
+package curation
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sync"
+
+	tor "git.torproject.org/user/phw/zoossh.git"
+
+	"github.com/NullHypothesis/sybilhunter/uptimestore"
+)
+
+// Curator drives a pipeline of CurationProcessors over a SeriesStore.  It
+// assumes callers replay the full consensus stream on every run -- the same
+// way sybilhunter's existing cache directory works -- and uses Resumable to
+// skip back over the prefix it has already ingested, so repeated runs never
+// redo work for old consensuses.
+type Curator struct {
+	dir   string
+	store *uptimestore.SeriesStore
+
+	mu        sync.Mutex
+	consumed  int64
+	checksums map[tor.Fingerprint]uint64
+	changed   map[tor.Fingerprint]bool
+	cohorts   map[tor.Fingerprint]int
+
+	processors []CurationProcessor
+}
+
+// NewCurator opens (or creates) a Curator rooted at dir, restoring its
+// watermark, per-relay checksums, and CohortProcessor's cohort assignments
+// from a previous run if one exists.
+func NewCurator(store *uptimestore.SeriesStore, dir string) (*Curator, error) {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("cannot create curator directory %s: %s\n", dir, err)
+	}
+
+	curator := &Curator{
+		dir:       dir,
+		store:     store,
+		checksums: make(map[tor.Fingerprint]uint64),
+		changed:   make(map[tor.Fingerprint]bool),
+		cohorts:   make(map[tor.Fingerprint]int),
+	}
+
+	if err := curator.loadWatermark(); err != nil {
+		return nil, err
+	}
+	if err := curator.loadChecksums(); err != nil {
+		return nil, err
+	}
+	if err := curator.loadCohorts(); err != nil {
+		return nil, err
+	}
+
+	return curator, nil
+}
+
+// Register adds a CurationProcessor to the pipeline.  Processors run in
+// registration order during RunPass.
+func (c *Curator) Register(p CurationProcessor) {
+
+	c.processors = append(c.processors, p)
+}
+
+// Resumable reports how many leading consensuses of a freshly-replayed
+// stream the curator has already ingested and should skip.
+func (c *Curator) Resumable() int64 {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.consumed
+}
+
+// Ingest records one consensus's worth of relay uptime at the given
+// (day, hour) and marks every relay it touches as changed since the last
+// pass.  It does not persist the watermark itself -- RunPass does that once
+// per pass, rather than paying for a full watermark rewrite on every single
+// consensus.
+func (c *Curator) Ingest(objects tor.ObjectSet, day, hour int) error {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for object := range objects.Iterate() {
+		fpr := object.GetFingerprint()
+		if err := c.store.MarkOnline(fpr, day, uint(hour)); err != nil {
+			return err
+		}
+		c.changed[fpr] = true
+	}
+
+	c.consumed++
+	return nil
+}
+
+// RunPass runs every registered CurationProcessor over the relays that
+// changed since the last pass, then clears the changed set and flushes the
+// checksum table, watermark, cohort assignments, and store to disk.
+// Persisting once per pass, rather than once per Ingest call, keeps a
+// multi-month resumed run from paying for a full watermark rewrite on every
+// single consensus.
+func (c *Curator) RunPass() (*Pass, error) {
+
+	c.mu.Lock()
+	changed := make(map[tor.Fingerprint]bool, len(c.changed))
+	for fpr := range c.changed {
+		changed[fpr] = true
+	}
+	c.mu.Unlock()
+
+	// A relay whose on-disk checksum no longer matches what the last pass
+	// recorded, despite never going through Ingest, has drifted silently --
+	// e.g. a store shared with another writer.  Flag it too, so this pass
+	// re-examines it like any other changed relay instead of leaving the
+	// checksum table quietly stale forever.
+	for fpr, want := range c.checksums {
+		if changed[fpr] {
+			continue
+		}
+		seq, err := c.store.Sequence(fpr)
+		if err != nil {
+			continue
+		}
+		if sequenceChecksum(fpr, seq) != want {
+			changed[fpr] = true
+		}
+	}
+
+	changedList := make([]tor.Fingerprint, 0, len(changed))
+	for fpr := range changed {
+		changedList = append(changedList, fpr)
+	}
+
+	pass := &Pass{Store: c.store, Changed: changedList, Cohorts: c.cohorts, Results: make(map[string]interface{})}
+
+	for _, p := range c.processors {
+		if err := p.Process(pass); err != nil {
+			return nil, fmt.Errorf("curation processor %q failed: %s\n", p.Name(), err)
+		}
+	}
+
+	c.mu.Lock()
+	c.cohorts = pass.Cohorts
+	for _, fpr := range changedList {
+		if seq, err := c.store.Sequence(fpr); err == nil {
+			c.checksums[fpr] = sequenceChecksum(fpr, seq)
+		}
+		delete(c.changed, fpr)
+	}
+	c.mu.Unlock()
+
+	if err := c.persistChecksums(); err != nil {
+		return nil, err
+	}
+	if err := c.persistWatermark(); err != nil {
+		return nil, err
+	}
+	if err := c.persistCohorts(); err != nil {
+		return nil, err
+	}
+	if err := c.store.Flush(); err != nil {
+		return nil, err
+	}
+
+	return pass, nil
+}
+
+// sequenceChecksum derives a watermark checksum from a relay's fingerprint
+// and its full online/offline bitmap, so two sequences with the same total
+// uptime but a different flip pattern -- exactly what ChurnProcessor exists
+// to catch -- hash differently.  It's not meant to catch every possible
+// mutation, only to let future passes confirm that a relay they already
+// processed hasn't silently drifted.
+func sequenceChecksum(fpr tor.Fingerprint, seq uptimestore.OnlineSequence) uint64 {
+
+	h := fnv.New64a()
+	h.Write([]byte(fpr))
+	binary.Write(h, binary.LittleEndian, uint32(len(seq)))
+	for _, day := range seq {
+		binary.Write(h, binary.LittleEndian, uint32(day))
+	}
+
+	return h.Sum64()
+}
@@ -0,0 +1,34 @@
+package curation
+
+import (
+	"testing"
+
+	"github.com/NullHypothesis/sybilhunter/uptimestore"
+
+	tor "git.torproject.org/user/phw/zoossh.git"
+)
+
+// TestSequenceChecksumDetectsReorderedFlips checks that two sequences with
+// the same total online-hour count but a different flip pattern -- exactly
+// what ChurnProcessor is supposed to catch -- hash differently.
+func TestSequenceChecksumDetectsReorderedFlips(t *testing.T) {
+
+	fpr := tor.Fingerprint("AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA")
+
+	var dayA, dayB uptimestore.Day
+	dayA.MarkOnline(0)
+	dayA.MarkOnline(1)
+	dayB.MarkOnline(22)
+	dayB.MarkOnline(23)
+
+	seqA := uptimestore.OnlineSequence{dayA, dayB}
+	seqB := uptimestore.OnlineSequence{dayB, dayA}
+
+	if seqA.TotalUptime() != seqB.TotalUptime() {
+		t.Fatalf("test sequences must share the same total uptime: %d != %d", seqA.TotalUptime(), seqB.TotalUptime())
+	}
+
+	if sequenceChecksum(fpr, seqA) == sequenceChecksum(fpr, seqB) {
+		t.Fatalf("checksum did not change for a reordered-but-same-total sequence")
+	}
+}
@@ -0,0 +1,232 @@
+package curation
+
+import (
+	tor "git.torproject.org/user/phw/zoossh.git"
+
+	"github.com/NullHypothesis/sybilhunter/uptimestore"
+)
+
+// Pass carries the state a CurationProcessor needs for one RunPass: the
+// store to read sequences from, the relays that changed since the last
+// pass, the cohort assignments CohortProcessor has accumulated across every
+// run so far, and a Results map processors use to hand their findings back
+// to whoever invoked the curator.
+type Pass struct {
+	Store   *uptimestore.SeriesStore
+	Changed []tor.Fingerprint
+	Cohorts map[tor.Fingerprint]int
+	Results map[string]interface{}
+}
+
+// CurationProcessor is a pluggable analysis pass a Curator runs over the
+// relays that changed since the previous pass.
+type CurationProcessor interface {
+	// Name identifies the processor, and is used as the key under which it
+	// stores its findings in Pass.Results.
+	Name() string
+
+	// Process analyses pass.Changed and records its findings in
+	// pass.Results[p.Name()].
+	Process(pass *Pass) error
+}
+
+// SybilHighlightProcessor reproduces sybilhunter's original behaviour --
+// highlighting relays whose uptime sequence is suspiciously close to
+// another's -- but only recomputes uptime distance for pairs involving a
+// relay that changed since the last pass, rather than every pair in the
+// store.
+type SybilHighlightProcessor struct {
+	// MaxDistance is the uptime distance below which two relays are
+	// considered suspiciously similar.  Zero means 0.0002, sybilhunter's
+	// long-standing default.
+	MaxDistance float32
+}
+
+// Name implements CurationProcessor.
+func (p *SybilHighlightProcessor) Name() string {
+
+	return "sybil-highlight"
+}
+
+// Process implements CurationProcessor.  It stores a
+// map[tor.Fingerprint]bool of suspiciously similar relays in
+// pass.Results["sybil-highlight"].
+func (p *SybilHighlightProcessor) Process(pass *Pass) error {
+
+	maxDistance := p.MaxDistance
+	if maxDistance == 0 {
+		maxDistance = uptimestore.MaxDistanceDefault
+	}
+
+	changed := make(map[tor.Fingerprint]bool, len(pass.Changed))
+	for _, fpr := range pass.Changed {
+		changed[fpr] = true
+	}
+
+	fprs := pass.Store.Fingerprints()
+	highlights := make(map[tor.Fingerprint]bool)
+
+	for _, fpr := range fprs {
+		if !changed[fpr] {
+			continue
+		}
+		for _, other := range fprs {
+			if fpr == other {
+				continue
+			}
+			distance, err := pass.Store.UptimeDistance(fpr, other)
+			if err != nil {
+				continue
+			}
+			if distance < maxDistance {
+				highlights[fpr] = true
+				highlights[other] = true
+			}
+		}
+	}
+
+	pass.Results[p.Name()] = highlights
+	return nil
+}
+
+// ChurnProcessor flags relays whose uptime bitmap flipped online/offline
+// more than MaxFlips times over the trailing week, a strong tell for relays
+// being cycled in and out of a Sybil pool.
+type ChurnProcessor struct {
+	// MaxFlips is the flip-count threshold above which a relay is flagged.
+	// Zero means 20.
+	MaxFlips int
+}
+
+// Name implements CurationProcessor.
+func (p *ChurnProcessor) Name() string {
+
+	return "churn"
+}
+
+// Process implements CurationProcessor.  It stores a
+// map[tor.Fingerprint]int of flagged relays to their flip count in
+// pass.Results["churn"].
+func (p *ChurnProcessor) Process(pass *Pass) error {
+
+	const windowDays = 7
+
+	maxFlips := p.MaxFlips
+	if maxFlips == 0 {
+		maxFlips = 20
+	}
+
+	flagged := make(map[tor.Fingerprint]int)
+
+	for _, fpr := range pass.Changed {
+		length, err := pass.Store.SequenceLength(fpr)
+		if err != nil {
+			continue
+		}
+
+		start := length - windowDays
+		if start < 0 {
+			start = 0
+		}
+
+		band, err := pass.Store.SequenceBand(fpr, start, length-start)
+		if err != nil {
+			continue
+		}
+
+		flips := 0
+		first := true
+		var prev bool
+		for _, day := range band {
+			var hour uint32
+			for hour = 0; hour < 24; hour++ {
+				online := day.IsOnline(hour)
+				if !first && online != prev {
+					flips++
+				}
+				prev = online
+				first = false
+			}
+		}
+
+		if flips > maxFlips {
+			flagged[fpr] = flips
+		}
+	}
+
+	pass.Results[p.Name()] = flagged
+	return nil
+}
+
+// CohortProcessor assigns each changed relay that has no cohort yet to the
+// cohort of the first already-assigned relay within MaxDistance of it, or
+// else to a new cohort of its own.  Every relay it sees ends up in some
+// cohort: it does not consult which relays other processors flagged, so
+// cohorts are not limited to suspicious fingerprints.  Unlike
+// SybilHighlightProcessor and ChurnProcessor,
+// its whole point is to remember cluster membership across runs, so it reads
+// and writes pass.Cohorts, which the Curator loads from and persists to disk
+// itself -- a fresh CohortProcessor can be registered on every run without
+// losing anything.
+type CohortProcessor struct {
+	// MaxDistance is the uptime distance below which a relay is considered
+	// part of an existing cohort.  Zero means 0.0002.
+	MaxDistance float32
+}
+
+// Name implements CurationProcessor.
+func (p *CohortProcessor) Name() string {
+
+	return "cohort"
+}
+
+// Process implements CurationProcessor.  It stores a
+// map[tor.Fingerprint]int of newly-assigned relays to cohort ID in
+// pass.Results["cohort"].
+func (p *CohortProcessor) Process(pass *Pass) error {
+
+	if pass.Cohorts == nil {
+		pass.Cohorts = make(map[tor.Fingerprint]int)
+	}
+
+	maxDistance := p.MaxDistance
+	if maxDistance == 0 {
+		maxDistance = uptimestore.MaxDistanceDefault
+	}
+
+	nextCohort := 0
+	for _, cohort := range pass.Cohorts {
+		if cohort > nextCohort {
+			nextCohort = cohort
+		}
+	}
+
+	assignments := make(map[tor.Fingerprint]int)
+
+	for _, fpr := range pass.Changed {
+		if _, known := pass.Cohorts[fpr]; known {
+			continue
+		}
+
+		for known, cohort := range pass.Cohorts {
+			distance, err := pass.Store.UptimeDistance(fpr, known)
+			if err != nil {
+				continue
+			}
+			if distance < maxDistance {
+				pass.Cohorts[fpr] = cohort
+				assignments[fpr] = cohort
+				break
+			}
+		}
+
+		if _, assigned := pass.Cohorts[fpr]; !assigned {
+			nextCohort++
+			pass.Cohorts[fpr] = nextCohort
+			assignments[fpr] = nextCohort
+		}
+	}
+
+	pass.Results[p.Name()] = assignments
+	return nil
+}
@@ -0,0 +1,234 @@
+package curation
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	tor "git.torproject.org/user/phw/zoossh.git"
+)
+
+const (
+	watermarkMagic   = "SHCW"
+	watermarkVersion = 1
+
+	checksumMagic   = "SHCK"
+	checksumVersion = 1
+
+	cohortMagic   = "SHCH"
+	cohortVersion = 1
+)
+
+func (c *Curator) watermarkPath() string {
+
+	return filepath.Join(c.dir, "watermark.db")
+}
+
+func (c *Curator) checksumPath() string {
+
+	return filepath.Join(c.dir, "checksums.db")
+}
+
+func (c *Curator) cohortPath() string {
+
+	return filepath.Join(c.dir, "cohorts.db")
+}
+
+// loadWatermark restores how many consensuses a previous run already
+// ingested.
+func (c *Curator) loadWatermark() error {
+
+	fd, err := os.Open(c.watermarkPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("cannot open curator watermark: %s\n", err)
+	}
+	defer fd.Close()
+
+	header := make([]byte, len(watermarkMagic)+1)
+	if _, err := io.ReadFull(fd, header); err != nil {
+		return fmt.Errorf("cannot read curator watermark header: %s\n", err)
+	}
+	if string(header[:len(watermarkMagic)]) != watermarkMagic {
+		return fmt.Errorf("curator watermark has unexpected magic header\n")
+	}
+	if header[len(watermarkMagic)] != watermarkVersion {
+		return fmt.Errorf("curator watermark has unsupported version %d\n", header[len(watermarkMagic)])
+	}
+
+	return binary.Read(fd, binary.LittleEndian, &c.consumed)
+}
+
+// persistWatermark writes the number of consensuses ingested so far.
+func (c *Curator) persistWatermark() error {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fd, err := os.Create(c.watermarkPath())
+	if err != nil {
+		return fmt.Errorf("cannot write curator watermark: %s\n", err)
+	}
+	defer fd.Close()
+
+	if _, err := fd.WriteString(watermarkMagic); err != nil {
+		return err
+	}
+	if _, err := fd.Write([]byte{watermarkVersion}); err != nil {
+		return err
+	}
+
+	return binary.Write(fd, binary.LittleEndian, c.consumed)
+}
+
+// loadChecksums restores the per-relay checksums recorded by the last
+// RunPass.
+func (c *Curator) loadChecksums() error {
+
+	fd, err := os.Open(c.checksumPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("cannot open curator checksums: %s\n", err)
+	}
+	defer fd.Close()
+
+	reader := bufio.NewReader(fd)
+	header := make([]byte, len(checksumMagic)+1)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return fmt.Errorf("cannot read curator checksum header: %s\n", err)
+	}
+	if string(header[:len(checksumMagic)]) != checksumMagic {
+		return fmt.Errorf("curator checksums have unexpected magic header\n")
+	}
+	if header[len(checksumMagic)] != checksumVersion {
+		return fmt.Errorf("curator checksums have unsupported version %d\n", header[len(checksumMagic)])
+	}
+
+	for {
+		var fprLen uint16
+		if err := binary.Read(reader, binary.LittleEndian, &fprLen); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+
+		fprBytes := make([]byte, fprLen)
+		if _, err := io.ReadFull(reader, fprBytes); err != nil {
+			return err
+		}
+
+		var checksum uint64
+		if err := binary.Read(reader, binary.LittleEndian, &checksum); err != nil {
+			return err
+		}
+
+		c.checksums[tor.Fingerprint(fprBytes)] = checksum
+	}
+
+	return nil
+}
+
+// persistChecksums rewrites the checksum file from the in-memory table.
+func (c *Curator) persistChecksums() error {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fd, err := os.Create(c.checksumPath())
+	if err != nil {
+		return fmt.Errorf("cannot write curator checksums: %s\n", err)
+	}
+	defer fd.Close()
+
+	writer := bufio.NewWriter(fd)
+	writer.WriteString(checksumMagic)
+	writer.WriteByte(checksumVersion)
+
+	for fpr, checksum := range c.checksums {
+		binary.Write(writer, binary.LittleEndian, uint16(len(fpr)))
+		writer.WriteString(string(fpr))
+		binary.Write(writer, binary.LittleEndian, checksum)
+	}
+
+	return writer.Flush()
+}
+
+// loadCohorts restores CohortProcessor's cohort assignments from a previous
+// run.
+func (c *Curator) loadCohorts() error {
+
+	fd, err := os.Open(c.cohortPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("cannot open curator cohorts: %s\n", err)
+	}
+	defer fd.Close()
+
+	reader := bufio.NewReader(fd)
+	header := make([]byte, len(cohortMagic)+1)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return fmt.Errorf("cannot read curator cohorts header: %s\n", err)
+	}
+	if string(header[:len(cohortMagic)]) != cohortMagic {
+		return fmt.Errorf("curator cohorts have unexpected magic header\n")
+	}
+	if header[len(cohortMagic)] != cohortVersion {
+		return fmt.Errorf("curator cohorts have unsupported version %d\n", header[len(cohortMagic)])
+	}
+
+	for {
+		var fprLen uint16
+		if err := binary.Read(reader, binary.LittleEndian, &fprLen); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+
+		fprBytes := make([]byte, fprLen)
+		if _, err := io.ReadFull(reader, fprBytes); err != nil {
+			return err
+		}
+
+		var cohort int64
+		if err := binary.Read(reader, binary.LittleEndian, &cohort); err != nil {
+			return err
+		}
+
+		c.cohorts[tor.Fingerprint(fprBytes)] = int(cohort)
+	}
+
+	return nil
+}
+
+// persistCohorts rewrites the cohort file from the in-memory table.
+func (c *Curator) persistCohorts() error {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fd, err := os.Create(c.cohortPath())
+	if err != nil {
+		return fmt.Errorf("cannot write curator cohorts: %s\n", err)
+	}
+	defer fd.Close()
+
+	writer := bufio.NewWriter(fd)
+	writer.WriteString(cohortMagic)
+	writer.WriteByte(cohortVersion)
+
+	for fpr, cohort := range c.cohorts {
+		binary.Write(writer, binary.LittleEndian, uint16(len(fpr)))
+		writer.WriteString(string(fpr))
+		binary.Write(writer, binary.LittleEndian, int64(cohort))
+	}
+
+	return writer.Flush()
+}
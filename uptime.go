@@ -3,284 +3,445 @@
 package main
 
 import (
-	"fmt"
+	"container/heap"
 	"image"
 	"image/color"
 	"image/jpeg"
 	"log"
 	"math"
 	"os"
+	"runtime"
 	"sort"
 	"sync"
 	"time"
 
+	"github.com/NullHypothesis/sybilhunter/curation"
+	"github.com/NullHypothesis/sybilhunter/uptimestore"
+
 	tor "git.torproject.org/user/phw/zoossh.git"
 )
 
 const (
 	tolerance   = 3
 	blockLength = 5
-	maxDistance = 0.0002
-)
+	maxDistance = uptimestore.MaxDistanceDefault
 
-// numBits maps an 8-bit integer to the numbers of its bits.
-var numBits = map[int]int{
-	0: 0, 1: 1, 2: 1, 3: 2, 4: 1, 5: 2, 6: 2, 7: 3, 8: 1, 9: 2,
-	10: 2, 11: 3, 12: 2, 13: 3, 14: 3, 15: 4, 16: 1, 17: 2, 18: 2, 19: 3,
-	20: 2, 21: 3, 22: 3, 23: 4, 24: 2, 25: 3, 26: 3, 27: 4, 28: 3, 29: 4,
-	30: 4, 31: 5, 32: 1, 33: 2, 34: 2, 35: 3, 36: 2, 37: 3, 38: 3, 39: 4,
-	40: 2, 41: 3, 42: 3, 43: 4, 44: 3, 45: 4, 46: 4, 47: 5, 48: 2, 49: 3,
-	50: 3, 51: 4, 52: 3, 53: 4, 54: 4, 55: 5, 56: 3, 57: 4, 58: 4, 59: 5,
-	60: 4, 61: 5, 62: 5, 63: 6, 64: 1, 65: 2, 66: 2, 67: 3, 68: 2, 69: 3,
-	70: 3, 71: 4, 72: 2, 73: 3, 74: 3, 75: 4, 76: 3, 77: 4, 78: 4, 79: 5,
-	80: 2, 81: 3, 82: 3, 83: 4, 84: 3, 85: 4, 86: 4, 87: 5, 88: 3, 89: 4,
-	90: 4, 91: 5, 92: 4, 93: 5, 94: 5, 95: 6, 96: 2, 97: 3, 98: 3, 99: 4,
-	100: 3, 101: 4, 102: 4, 103: 5, 104: 3, 105: 4, 106: 4, 107: 5, 108: 4, 109: 5,
-	110: 5, 111: 6, 112: 3, 113: 4, 114: 4, 115: 5, 116: 4, 117: 5, 118: 5, 119: 6,
-	120: 4, 121: 5, 122: 5, 123: 6, 124: 5, 125: 6, 126: 6, 127: 7, 128: 1, 129: 2,
-	130: 2, 131: 3, 132: 2, 133: 3, 134: 3, 135: 4, 136: 2, 137: 3, 138: 3, 139: 4,
-	140: 3, 141: 4, 142: 4, 143: 5, 144: 2, 145: 3, 146: 3, 147: 4, 148: 3, 149: 4,
-	150: 4, 151: 5, 152: 3, 153: 4, 154: 4, 155: 5, 156: 4, 157: 5, 158: 5, 159: 6,
-	160: 2, 161: 3, 162: 3, 163: 4, 164: 3, 165: 4, 166: 4, 167: 5, 168: 3, 169: 4,
-	170: 4, 171: 5, 172: 4, 173: 5, 174: 5, 175: 6, 176: 3, 177: 4, 178: 4, 179: 5,
-	180: 4, 181: 5, 182: 5, 183: 6, 184: 4, 185: 5, 186: 5, 187: 6, 188: 5, 189: 6,
-	190: 6, 191: 7, 192: 2, 193: 3, 194: 3, 195: 4, 196: 3, 197: 4, 198: 4, 199: 5,
-	200: 3, 201: 4, 202: 4, 203: 5, 204: 4, 205: 5, 206: 5, 207: 6, 208: 3, 209: 4,
-	210: 4, 211: 5, 212: 4, 213: 5, 214: 5, 215: 6, 216: 4, 217: 5, 218: 5, 219: 6,
-	220: 5, 221: 6, 222: 6, 223: 7, 224: 3, 225: 4, 226: 4, 227: 5, 228: 4, 229: 5,
-	230: 5, 231: 6, 232: 4, 233: 5, 234: 5, 235: 6, 236: 5, 237: 6, 238: 6, 239: 7,
-	240: 4, 241: 5, 242: 5, 243: 6, 244: 5, 245: 6, 246: 6, 247: 7, 248: 5, 249: 6,
-	250: 6, 251: 7, 252: 6, 253: 7, 254: 7, 255: 8,
-}
+	// imageTileDays is the number of days rendered into the output image at
+	// a time.  Rendering in tiles keeps peak memory proportional to
+	// imageTileDays * relay count rather than the full matrix.
+	imageTileDays = 30
+)
 
 // Highlights stores which columns in the resulting image should be
 // highlighted.
-type Highlights map[int]bool
+type Highlights map[int]uptimestore.GroupID
+
+// OrderedUptimes is used to sort columns in the picture.  Fingerprints holds
+// only fingerprints; the sequences themselves stay on disk in Store and are
+// fetched on demand.  totalUptime and median cache each fingerprint's
+// OnlineSequence.TotalUptime and Median so the sort comparator, which is
+// invoked O(n log n) times, never re-reads a chunk from disk.
+type OrderedUptimes struct {
+	Store        *uptimestore.SeriesStore
+	Fingerprints []tor.Fingerprint
+	totalUptime  []int
+	median       []float32
+}
 
-// Day represents the uptime/downtime pattern of a relay for a single day.
-type Day uint32
+// Len implements the sort interface.
+func (ou OrderedUptimes) Len() int {
+
+	return len(ou.Fingerprints)
+}
 
-// MarkOnline marks a given hour in the day as online, i.e., it sets the bit
-// position to 1.
-func (day *Day) MarkOnline(hour uint) {
+// Swap implements the sort interface.
+func (ou OrderedUptimes) Swap(i, j int) {
 
-	*day = Day(uint32(*day) | (1 << hour))
+	ou.Fingerprints[i], ou.Fingerprints[j] = ou.Fingerprints[j], ou.Fingerprints[i]
+	ou.totalUptime[i], ou.totalUptime[j] = ou.totalUptime[j], ou.totalUptime[i]
+	ou.median[i], ou.median[j] = ou.median[j], ou.median[i]
 }
 
-// IsOnline returns true if the relay was online at the given hour.
-func (day *Day) IsOnline(hour uint32) bool {
+// Less implements the sort interface.  It reads only the cached totalUptime
+// and median slices, so it runs in O(1) regardless of how long a relay's
+// history is.
+func (ou OrderedUptimes) Less(i, j int) bool {
 
-	return (uint32(*day) & (1 << hour)) > 0
+	diff := ou.totalUptime[i] - ou.totalUptime[j]
+	if (diff > -tolerance) && (diff < tolerance) {
+		return ou.median[i] < ou.median[j]
+	}
+	return ou.totalUptime[i] < ou.totalUptime[j]
 }
 
-// OnlineSequence represents a sequence of days.
-type OnlineSequence []Day
+// precompute populates totalUptime and median for every fingerprint, each of
+// which touches the store once, so that Less never has to.
+func (ou *OrderedUptimes) precompute() {
 
-// AddDay adds a day to the online sequence.
-func (seq *OnlineSequence) AddDay() {
+	ou.totalUptime = make([]int, len(ou.Fingerprints))
+	ou.median = make([]float32, len(ou.Fingerprints))
 
-	*seq = append(*seq, Day(0))
+	for i, fpr := range ou.Fingerprints {
+		total, err := ou.Store.TotalUptime(fpr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		median, err := ou.Store.Median(fpr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ou.totalUptime[i] = total
+		ou.median[i] = median
+	}
 }
 
-// TotalUptime counts the number of hours, the relay was online.
-func (seq *OnlineSequence) TotalUptime() int {
+// dropMostlyOnline removes the same "mostly online" relays PruneUptimes
+// would, keeping totalUptime and median aligned with Fingerprints, but
+// without touching store -- callers that persist store across runs (i.e.
+// curateUptimes) need every relay's real history to stay on disk for the
+// next resumed run, even if this particular render hides it.
+func (ou *OrderedUptimes) dropMostlyOnline(store *uptimestore.SeriesStore) {
+
+	fprs := ou.Fingerprints[:0]
+	totalUptime := ou.totalUptime[:0]
+	median := ou.median[:0]
+	hidden := 0
+
+	for i, fpr := range ou.Fingerprints {
+		length, err := store.SequenceLength(fpr)
+		if err != nil {
+			log.Fatal(err)
+		}
 
-	total := 0
-	for _, day := range *seq {
-		byte1 := numBits[(int(day)&0x000000ff)>>0]
-		byte2 := numBits[(int(day)&0x0000ff00)>>8]
-		byte3 := numBits[(int(day)&0x00ff0000)>>16]
-		byte4 := numBits[(int(day)&0xff000000)>>24]
+		if ou.totalUptime[i] == length*24 {
+			hidden++
+			continue
+		}
 
-		total += (byte1 + byte2 + byte3 + byte4)
+		fprs = append(fprs, fpr)
+		totalUptime = append(totalUptime, ou.totalUptime[i])
+		median = append(median, ou.median[i])
 	}
 
-	return total
+	ou.Fingerprints = fprs
+	ou.totalUptime = totalUptime
+	ou.median = median
+
+	log.Printf("Hid %d (out of %d) relays that were mostly online from this render.\n", hidden, hidden+len(fprs))
 }
 
-// Median determines the median of the given online sequence.
-func (seq *OnlineSequence) Median() float32 {
+// SortUptimes sorts uptime sequences, so uptimes that are visually similar are
+// close to each other.  It shards the fingerprint list across a worker pool
+// sized to runtime.GOMAXPROCS, sorts each shard concurrently, and merges the
+// sorted shards back together; Less's two-tier comparison is order-preserving
+// across that merge.
+func SortUptimes(store *uptimestore.SeriesStore) *OrderedUptimes {
 
-	var hour uint32
-	indices := make([]uint32, 0)
+	start := time.Now()
 
-	for i, day := range *seq {
-		for hour = 0; hour < 24; hour++ {
-			if day.IsOnline(hour) {
-				indices = append(indices, uint32(i)+hour)
-			}
-		}
+	ordered := &OrderedUptimes{
+		Store:        store,
+		Fingerprints: store.Fingerprints(),
 	}
+	ordered.precompute()
+	ordered.parallelSort()
 
-	indicesLen := len(indices)
-	if indicesLen == 0 {
-		log.Fatalln("Length of indices for calculation of median must not be zero.  Bug?")
-	} else if indicesLen == 1 {
-		return float32(indices[0])
-	}
+	log.Printf("Done sorting list after %s.\n", time.Since(start))
 
-	if (indicesLen % 2) == 0 {
-		idx := indicesLen / 2
-		return float32(indices[idx-1]+indices[idx]) / 2
-	} else {
-		idx := int(math.Ceil(float64(indicesLen) / 2))
-		return float32(indices[idx])
-	}
+	return ordered
 }
 
-// OrderedUptimes is used to sort columns in the picture.
-type OrderedUptimes struct {
-	Fingerprints []tor.Fingerprint
-	Sequences    []OnlineSequence
-}
+// parallelSort splits the fingerprint list into shards, sorts each shard in
+// its own goroutine, and k-way merges the results back into ou.
+func (ou *OrderedUptimes) parallelSort() {
 
-// Len implements the sort interface.
-func (ou OrderedUptimes) Len() int {
+	n := len(ou.Fingerprints)
+	shards := runtime.GOMAXPROCS(0)
+	if shards > n {
+		shards = n
+	}
+	if shards < 1 {
+		shards = 1
+	}
 
-	return len(ou.Fingerprints)
+	parts := make([]*OrderedUptimes, shards)
+	var group sync.WaitGroup
+
+	for s := 0; s < shards; s++ {
+		lo := s * n / shards
+		hi := (s + 1) * n / shards
+
+		part := &OrderedUptimes{
+			Store:        ou.Store,
+			Fingerprints: append([]tor.Fingerprint(nil), ou.Fingerprints[lo:hi]...),
+			totalUptime:  append([]int(nil), ou.totalUptime[lo:hi]...),
+			median:       append([]float32(nil), ou.median[lo:hi]...),
+		}
+		parts[s] = part
+
+		group.Add(1)
+		go func(part *OrderedUptimes) {
+			defer group.Done()
+			sort.Sort(part)
+		}(part)
+	}
+	group.Wait()
+
+	merged := mergeSortedShards(parts)
+	ou.Fingerprints = merged.Fingerprints
+	ou.totalUptime = merged.totalUptime
+	ou.median = merged.median
 }
 
-// Swap implements the sort interface.
-func (ou OrderedUptimes) Swap(i, j int) {
+// shardCursor tracks how far a k-way merge has consumed a single sorted
+// shard.
+type shardCursor struct {
+	shard int
+	index int
+}
 
-	ou.Sequences[i], ou.Sequences[j] = ou.Sequences[j], ou.Sequences[i]
-	ou.Fingerprints[i], ou.Fingerprints[j] = ou.Fingerprints[j], ou.Fingerprints[i]
+// shardHeap is a min-heap of shardCursors, ordered by the same two-tier
+// comparison OrderedUptimes.Less uses, that drives mergeSortedShards.
+type shardHeap struct {
+	parts   []*OrderedUptimes
+	cursors []shardCursor
 }
 
-// Less implements the sort interface.
-func (ou OrderedUptimes) Less(i, j int) bool {
+func (h shardHeap) Len() int { return len(h.cursors) }
 
-	total1 := ou.Sequences[i].TotalUptime()
-	total2 := ou.Sequences[j].TotalUptime()
+func (h shardHeap) Less(i, j int) bool {
 
-	diff := total1 - total2
+	a, b := h.cursors[i], h.cursors[j]
+	pa, pb := h.parts[a.shard], h.parts[b.shard]
+
+	diff := pa.totalUptime[a.index] - pb.totalUptime[b.index]
 	if (diff > -tolerance) && (diff < tolerance) {
-		median1 := ou.Sequences[i].Median()
-		median2 := ou.Sequences[j].Median()
-		return median1 < median2
-	} else {
-		return total1 < total2
+		return pa.median[a.index] < pb.median[b.index]
 	}
+	return pa.totalUptime[a.index] < pb.totalUptime[b.index]
 }
 
-// Uptimes maps relay fingerprints to their online sequence.
-type Uptimes struct {
-	ForFingerprint map[tor.Fingerprint]OnlineSequence
-}
+func (h shardHeap) Swap(i, j int) { h.cursors[i], h.cursors[j] = h.cursors[j], h.cursors[i] }
 
-// AddDay adds a day to all relays in the map.
-func (up *Uptimes) AddDay() {
+func (h *shardHeap) Push(x interface{}) { h.cursors = append(h.cursors, x.(shardCursor)) }
 
-	counter := 0
-	for fpr, seq := range up.ForFingerprint {
-		seq = append(seq, Day(0))
-		up.ForFingerprint[fpr] = seq
-		counter++
-	}
-}
+func (h *shardHeap) Pop() interface{} {
 
-// UptimeDistance determines the distance between two online sequences.
-func UptimeDistance(seq1, seq2 OnlineSequence) (float32, error) {
+	old := h.cursors
+	n := len(old)
+	cursor := old[n-1]
+	h.cursors = old[:n-1]
+	return cursor
+}
 
-	var distance, boost float32
-	var hour uint32
+// mergeSortedShards k-way merges already-sorted shards into a single
+// OrderedUptimes, preserving sort order.
+func mergeSortedShards(parts []*OrderedUptimes) *OrderedUptimes {
 
-	if len(seq1) != len(seq2) {
-		return 0, fmt.Errorf("Both sequences must have same length.\n")
+	total := 0
+	for _, part := range parts {
+		total += len(part.Fingerprints)
 	}
 
-	for day, _ := range seq1 {
-		for hour = 0; hour < 24; hour++ {
-			status1 := seq1[day].IsOnline(hour)
-			status2 := seq2[day].IsOnline(hour)
+	merged := &OrderedUptimes{
+		Fingerprints: make([]tor.Fingerprint, 0, total),
+		totalUptime:  make([]int, 0, total),
+		median:       make([]float32, 0, total),
+	}
+	if len(parts) > 0 {
+		merged.Store = parts[0].Store
+	}
 
-			// Relays don't have same status: increase distance and boost.
-			if status1 != status2 {
-				if boost < 1 {
-					boost += 0.1
-				}
-				distance += boost
-			} else {
-				boost = 0
-			}
+	h := &shardHeap{parts: parts}
+	for i, part := range parts {
+		if len(part.Fingerprints) > 0 {
+			heap.Push(h, shardCursor{shard: i, index: 0})
 		}
 	}
 
-	return distance / float32(len(seq1)*24), nil
-}
-
-// SortUptimes sorts uptime sequences, so uptimes that are visually similar are
-// close to each other.
-func SortUptimes(uptimes *Uptimes) *OrderedUptimes {
+	for h.Len() > 0 {
+		cursor := heap.Pop(h).(shardCursor)
+		part := parts[cursor.shard]
 
-	start := time.Now()
+		merged.Fingerprints = append(merged.Fingerprints, part.Fingerprints[cursor.index])
+		merged.totalUptime = append(merged.totalUptime, part.totalUptime[cursor.index])
+		merged.median = append(merged.median, part.median[cursor.index])
 
-	ordered := &OrderedUptimes{
-		Fingerprints: make([]tor.Fingerprint, 0),
-		Sequences:    make([]OnlineSequence, 0),
+		if cursor.index+1 < len(part.Fingerprints) {
+			heap.Push(h, shardCursor{shard: cursor.shard, index: cursor.index + 1})
+		}
 	}
 
-	for fpr, seq := range uptimes.ForFingerprint {
-		ordered.Fingerprints = append(ordered.Fingerprints, fpr)
-		ordered.Sequences = append(ordered.Sequences, seq)
+	return merged
+}
+
+// closeRun records the current adjacent-column run as its own highlight
+// group, if it spans at least blockLength similar adjacent pairs (i.e.
+// blockLength+1 columns), and returns the next
+// free GroupID.  It's shared by GetHighlights and GetCompositeHighlights,
+// which differ only in how they measure the distance between adjacent
+// columns.
+func closeRun(highlight Highlights, nextGroup uptimestore.GroupID, blockStart, runlength int) uptimestore.GroupID {
+
+	if runlength >= blockLength {
+		group := nextGroup
+		nextGroup++
+		for x := blockStart; x <= blockStart+runlength; x++ {
+			highlight[x] = group
+		}
 	}
 
-	sort.Sort(ordered)
+	return nextGroup
+}
 
-	log.Printf("Done sorting list after %s.\n", time.Since(start))
+// applyDispersedGroups adds groups's suspiciously-similar relays to
+// highlight, offsetting their GroupIDs past nextGroup so they never collide
+// with an adjacent-run group, and skipping any column an adjacent run
+// already claimed.
+func applyDispersedGroups(highlight Highlights, uptimes *OrderedUptimes, groups map[tor.Fingerprint]uptimestore.GroupID, nextGroup uptimestore.GroupID) {
 
-	return ordered
+	colIndex := make(map[tor.Fingerprint]int, len(uptimes.Fingerprints))
+	for i, fpr := range uptimes.Fingerprints {
+		colIndex[fpr] = i
+	}
+
+	for fpr, group := range groups {
+		col, exists := colIndex[fpr]
+		if !exists {
+			continue
+		}
+		if _, already := highlight[col]; already {
+			continue
+		}
+		highlight[col] = nextGroup + group
+	}
 }
 
 // GetHighlights attempts to highlight columns that are suspiciously similar.
 // The highlight is meant as a visual aide to find Sybils in the resulting
-// image.  Two columns are highlighted if their uptime distance is smaller than
-// the given threshold.
-func GetHighlights(uptimes *OrderedUptimes) *Highlights {
+// image.  Columns get grouped in two ways: a run of adjacent columns whose
+// uptime distance is smaller than the given threshold becomes its own
+// group, and GroupBySimilarity then adds relays whose sequences are
+// similar but ended up far apart in the sort order.
+func GetHighlights(uptimes *OrderedUptimes, lsh uptimestore.LSHParams) *Highlights {
 
 	highlight := Highlights{}
+	var nextGroup uptimestore.GroupID = 1
 	runlength := 0
-	hours := len(uptimes.Sequences[0]) * 24
+	blockStart := 0
 
 	// Determine distance between subsequent relay columns.
 	for i := 0; i < len(uptimes.Fingerprints)-1; i++ {
 
-		timeOnline := uptimes.Sequences[i].TotalUptime()
+		timeOnline := uptimes.totalUptime[i]
+		length, err := uptimes.Store.SequenceLength(uptimes.Fingerprints[i])
+		if err != nil {
+			log.Fatal(err)
+		}
+		hours := length * 24
 		if timeOnline < 5 || (hours-timeOnline) < 5 {
 			continue
 		}
 
-		distance, _ := UptimeDistance(uptimes.Sequences[i], uptimes.Sequences[i+1])
+		distance, _ := uptimes.Store.UptimeDistance(uptimes.Fingerprints[i], uptimes.Fingerprints[i+1])
 		if distance < maxDistance {
+			if runlength == 0 {
+				blockStart = i
+			}
 			runlength++
 		} else {
-			if runlength >= blockLength {
-				for x := 0; x >= -runlength; x-- {
-					highlight[i+x] = true
-				}
-			}
+			nextGroup = closeRun(highlight, nextGroup, blockStart, runlength)
 			runlength = 0
 		}
 	}
+	nextGroup = closeRun(highlight, nextGroup, blockStart, runlength)
+
+	groups, err := uptimestore.GroupBySimilarity(uptimes.Store, lsh)
+	if err != nil {
+		log.Printf("LSH grouping failed, falling back to adjacent-column highlights only: %s\n", err)
+		return &highlight
+	}
+
+	applyDispersedGroups(highlight, uptimes, groups, nextGroup)
 
 	return &highlight
 }
 
-// PruneUptimes gets rid of columns that are of little interest, i.e., relays
-// that are mostly online.
-func PruneUptimes(uptimes *Uptimes) {
+// GetCompositeHighlights is GetHighlights's counterpart for the
+// multi-resolution composite view: it highlights adjacent-column runs using
+// AggregatedDistance over aggregated (bucketed) rather than raw per-hour
+// sequences, since that's the representation GenCompositeImage actually
+// renders, then adds GroupBySimilarity's dispersed-cohort groups exactly
+// like GetHighlights does.  aggregated must be aligned with
+// uptimes.Fingerprints, e.g. as built by buildAggregatedSequences.
+func GetCompositeHighlights(uptimes *OrderedUptimes, aggregated []*uptimestore.AggregatedSequence, lsh uptimestore.LSHParams) *Highlights {
 
-	var mostlyOnline, maxOnline, prevRelays int
-	prevRelays = len(uptimes.ForFingerprint)
+	highlight := Highlights{}
+	var nextGroup uptimestore.GroupID = 1
+	runlength := 0
+	blockStart := 0
+
+	for i := 0; i < len(aggregated)-1; i++ {
+
+		distance, err := uptimestore.AggregatedDistance(aggregated[i], aggregated[i+1])
+		if err != nil {
+			nextGroup = closeRun(highlight, nextGroup, blockStart, runlength)
+			runlength = 0
+			continue
+		}
 
-	for fpr, seq := range uptimes.ForFingerprint {
-		if maxOnline == 0 {
-			maxOnline = len(seq) * 24
+		if distance < maxDistance {
+			if runlength == 0 {
+				blockStart = i
+			}
+			runlength++
+		} else {
+			nextGroup = closeRun(highlight, nextGroup, blockStart, runlength)
+			runlength = 0
 		}
+	}
+	nextGroup = closeRun(highlight, nextGroup, blockStart, runlength)
+
+	groups, err := uptimestore.GroupBySimilarity(uptimes.Store, lsh)
+	if err != nil {
+		log.Printf("LSH grouping failed, falling back to adjacent-column highlights only: %s\n", err)
+		return &highlight
+	}
+
+	applyDispersedGroups(highlight, uptimes, groups, nextGroup)
 
-		if seq.TotalUptime() == maxOnline {
+	return &highlight
+}
+
+// PruneUptimes gets rid of columns that are of little interest, i.e., relays
+// that are mostly online.  It hard-deletes them from store, so it's only
+// safe to call from a path that replays the full consensus stream on every
+// run (see AnalyseUptimes) -- a resumed run would otherwise fabricate a
+// fully-offline history for a pruned relay that later reappears, since
+// curateUptimes never replays the consensuses that originally proved it was
+// online.  curateUptimes uses dropMostlyOnline instead, which hides the same
+// relays from this render without touching the persisted store.
+func PruneUptimes(store *uptimestore.SeriesStore) {
+
+	fprs := store.Fingerprints()
+	prevRelays := len(fprs)
+	mostlyOnline := 0
+
+	for _, fpr := range fprs {
+		length, err := store.SequenceLength(fpr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		total, err := store.TotalUptime(fpr)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if total == length*24 {
 			mostlyOnline++
-			delete(uptimes.ForFingerprint, fpr)
+			if err := store.Delete(fpr); err != nil {
+				log.Fatal(err)
+			}
 		}
 	}
 
@@ -288,14 +449,25 @@ func PruneUptimes(uptimes *Uptimes) {
 }
 
 // AnalyseUptimes analyses the uptime pattern of Tor relays and generates an
-// image, that should help with finding Sybils.
+// image, that should help with finding Sybils.  If params.Resume is set, it
+// delegates to curateUptimes, which incrementally ingests the consensus
+// stream via a curation.Curator instead of redoing the whole store from
+// scratch on every run.
 func AnalyseUptimes(channel chan tor.ObjectSet, params *CmdLineParams, group *sync.WaitGroup) {
 
 	defer group.Done()
 
-	uptimes := Uptimes{
-		ForFingerprint: make(map[tor.Fingerprint]OnlineSequence),
+	if params.Resume {
+		curateUptimes(channel, params)
+		return
 	}
+
+	store, err := uptimestore.Open(params.StoreDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Flush()
+
 	hour := -1
 	daysPassed := -1
 
@@ -305,66 +477,238 @@ func AnalyseUptimes(channel chan tor.ObjectSet, params *CmdLineParams, group *sy
 		hour = (hour + 1) % 24
 		if hour == 0 {
 			daysPassed++
-			uptimes.AddDay()
+			if daysPassed > 0 {
+				if err := store.Tick(daysPassed - 1); err != nil {
+					log.Fatal(err)
+				}
+			}
 		}
 
 		// Iterate over all relays in the consensus.
 		for object := range objects.Iterate() {
 
 			fpr := object.GetFingerprint()
-			daySeq, exists := uptimes.ForFingerprint[fpr]
-			if !exists {
-				daySeq = make(OnlineSequence, daysPassed+1)
-				uptimes.ForFingerprint[fpr] = daySeq
+			if err := store.MarkOnline(fpr, daysPassed, uint(hour)); err != nil {
+				log.Fatal(err)
 			}
+		}
+	}
+
+	if store.NumRelays() == 0 {
+		log.Fatalln("No consensuses to process.  Exiting.")
+	}
 
-			last := len(daySeq) - 1
-			daySeq[last].MarkOnline(uint(hour))
+	if daysPassed >= 0 {
+		if err := store.Tick(daysPassed); err != nil {
+			log.Fatal(err)
 		}
 	}
 
-	if len(uptimes.ForFingerprint) == 0 {
+	PruneUptimes(store)
+	renderUptimes(SortUptimes(store), params)
+}
+
+// curateUptimes is AnalyseUptimes's incremental counterpart: it replays the
+// same consensus stream through a curation.Curator, which skips the prefix
+// it has already ingested on a resumed run and only re-runs its processors
+// for relays that changed since the last pass.
+func curateUptimes(channel chan tor.ObjectSet, params *CmdLineParams) {
+
+	store, err := uptimestore.Open(params.StoreDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Flush()
+
+	curator, err := curation.NewCurator(store, params.CurationDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	curator.Register(&curation.SybilHighlightProcessor{MaxDistance: maxDistance})
+	curator.Register(&curation.ChurnProcessor{})
+	curator.Register(&curation.CohortProcessor{})
+
+	skip := curator.Resumable()
+
+	hour := -1
+	daysPassed := -1
+	var seen int64
+
+	// One loop iteration corresponds to one consensus.  Counters keep
+	// advancing through the already-ingested prefix so they land on the
+	// right (day, hour) once real ingestion resumes.
+	for objects := range channel {
+
+		hour = (hour + 1) % 24
+		if hour == 0 {
+			daysPassed++
+			if daysPassed > 0 {
+				if err := store.Tick(daysPassed - 1); err != nil {
+					log.Fatal(err)
+				}
+			}
+		}
+
+		if seen < skip {
+			seen++
+			continue
+		}
+
+		if err := curator.Ingest(objects, daysPassed, hour); err != nil {
+			log.Fatal(err)
+		}
+		seen++
+	}
+
+	if store.NumRelays() == 0 {
 		log.Fatalln("No consensuses to process.  Exiting.")
 	}
 
-	PruneUptimes(&uptimes)
+	if daysPassed >= 0 {
+		if err := store.Tick(daysPassed); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if _, err := curator.RunPass(); err != nil {
+		log.Fatal(err)
+	}
+
+	sorted := SortUptimes(store)
+	sorted.dropMostlyOnline(store)
+	renderUptimes(sorted, params)
+}
+
+// renderUptimes writes sortedUptimes out as either a composite,
+// multi-resolution image (if params.Resolutions is set) or sybilhunter's
+// original adjacent-column highlight image.
+func renderUptimes(sortedUptimes *OrderedUptimes, params *CmdLineParams) {
+
+	if params.Resolutions != "" {
+		levels, err := uptimestore.ParseResolutions(params.Resolutions)
+		if err != nil {
+			log.Fatal(err)
+		}
+		now := time.Now()
+		aggregated := buildAggregatedSequences(sortedUptimes, levels, now)
+		highlight := GetCompositeHighlights(sortedUptimes, aggregated, lshParams(params))
+		GenCompositeImage(sortedUptimes, levels, aggregated, highlight, now, params.InputData)
+	} else {
+		GenImage(sortedUptimes, GetHighlights(sortedUptimes, lshParams(params)), params.InputData)
+	}
+}
+
+// buildAggregatedSequences builds one uptimestore.AggregatedSequence per
+// relay in uptimes, in column order, so GetCompositeHighlights and
+// GenCompositeImage can share the same aggregation pass instead of each
+// reading every relay's full sequence from disk a second time.
+func buildAggregatedSequences(uptimes *OrderedUptimes, levels []uptimestore.Resolution, now time.Time) []*uptimestore.AggregatedSequence {
+
+	aggregated := make([]*uptimestore.AggregatedSequence, len(uptimes.Fingerprints))
+	for i, fpr := range uptimes.Fingerprints {
+		seq, err := uptimes.Store.Sequence(fpr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		aggregated[i] = uptimestore.NewAggregatedSequence(seq, now, levels)
+	}
+
+	return aggregated
+}
+
+// lshParams builds the uptimestore.LSHParams used by the LSH-based grouping
+// step in GetHighlights from sybilhunter's --lsh-bits, --lsh-bands, and
+// --lsh-threshold flags, falling back to uptimestore's defaults for any
+// that weren't set.
+func lshParams(params *CmdLineParams) uptimestore.LSHParams {
+
+	lsh := uptimestore.DefaultLSHParams()
+
+	if params.LSHBits > 0 {
+		lsh.SignatureBits = params.LSHBits
+	}
+	if params.LSHBands > 0 {
+		lsh.NumBands = params.LSHBands
+	}
+	if params.LSHThreshold > 0 {
+		lsh.MinBands = params.LSHThreshold
+	}
+
+	return lsh
+}
+
+// maxSequenceLength returns the longest sequence length across every relay
+// in fprs.  GenImage and GenCompositeImage size their canvas off this rather
+// than off a single relay's length, since relays can legitimately end up
+// with sequences of different lengths (a relay that drops off the network
+// stops growing the moment the last run that saw it exits) and picking
+// whichever fingerprint happens to sort first would arbitrarily truncate or
+// pad the image depending on sort order.
+func maxSequenceLength(store *uptimestore.SeriesStore, fprs []tor.Fingerprint) int {
+
+	max := 0
+	for _, fpr := range fprs {
+		length, err := store.SequenceLength(fpr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if length > max {
+			max = length
+		}
+	}
 
-	sortedUptimes := SortUptimes(&uptimes)
-	GenImage(sortedUptimes, GetHighlights(sortedUptimes), params.InputData)
+	return max
 }
 
 // GenImage generates an images out of the generated uptime pattern.  Columns
-// that are suspiciously similar are highlighted.
+// that are suspiciously similar are highlighted.  The image is rendered in
+// row-bands of imageTileDays days at a time, so peak memory stays bounded by
+// imageTileDays * relay count rather than requiring every relay's full
+// history in memory at once.
 func GenImage(uptimes *OrderedUptimes, highlight *Highlights, fileName string) {
 
 	// x-axis: relay fingerprints, y-axis: uptime sequences.
 	x := len(uptimes.Fingerprints)
-	y := len(uptimes.Sequences[0]) * 24
+	totalDays := maxSequenceLength(uptimes.Store, uptimes.Fingerprints)
+	y := totalDays * 24
 
 	img := image.NewRGBA(image.Rect(0, 0, x, y))
 	offline := color.RGBA{255, 255, 255, 255}
 	online := color.RGBA{0, 0, 0, 255}
-	important := color.RGBA{255, 0, 0, 255}
 
 	log.Printf("Generating %dx%d uptime image.\n", x, y)
 
-	j := 0
-	var hour uint32
-	for x, _ := range uptimes.Fingerprints {
-		for y, day := range uptimes.Sequences[x] {
-			for hour = 0; hour < 24; hour++ {
-				if day.IsOnline(hour) {
-					if _, exists := (*highlight)[x]; exists {
-						img.Set(x, (y*24)+int(hour), important)
-					} else {
-						img.Set(x, (y*24)+int(hour), online)
+	for tileStart := 0; tileStart < totalDays; tileStart += imageTileDays {
+		tileDays := imageTileDays
+		if tileStart+tileDays > totalDays {
+			tileDays = totalDays - tileStart
+		}
+
+		for col, fpr := range uptimes.Fingerprints {
+			band, err := uptimes.Store.SequenceBand(fpr, tileStart, tileDays)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			group, highlighted := (*highlight)[col]
+
+			var hour uint32
+			for i, day := range band {
+				rowBase := (tileStart + i) * 24
+				for hour = 0; hour < 24; hour++ {
+					pixel := offline
+					if day.IsOnline(hour) {
+						if highlighted {
+							pixel = groupColor(group)
+						} else {
+							pixel = online
+						}
 					}
-				} else {
-					img.Set(x, (y*24)+int(hour), offline)
+					img.Set(col, rowBase+int(hour), pixel)
 				}
 			}
 		}
-		j++
 	}
 
 	fd, err := os.Create(fileName)
@@ -378,4 +722,158 @@ func GenImage(uptimes *OrderedUptimes, highlight *Highlights, fileName string) {
 	}
 
 	log.Printf("Wrote image file to: %s\n", fileName)
-}
\ No newline at end of file
+}
+
+// GenCompositeImage renders uptimes as a multi-resolution image: the y-axis
+// is divided into bands, one per resolution level, each showing that band's
+// span of history at its own bucket granularity.  This lets a single image
+// cover months of history -- at hourly detail near the top and coarser
+// detail further down -- without producing an impractically tall JPEG.
+// aggregated must be aligned with uptimes.Fingerprints and anchored at now,
+// e.g. as built by buildAggregatedSequences; highlight tints the suspicious
+// columns GetCompositeHighlights found the same way GenImage does.
+func GenCompositeImage(uptimes *OrderedUptimes, levels []uptimestore.Resolution, aggregated []*uptimestore.AggregatedSequence, highlight *Highlights, now time.Time, fileName string) {
+
+	x := len(uptimes.Fingerprints)
+	if x == 0 {
+		log.Fatalln("No relays to render.")
+	}
+
+	totalDays := maxSequenceLength(uptimes.Store, uptimes.Fingerprints)
+	totalHours := totalDays * 24
+
+	bucketCounts := make([]int, len(levels))
+	consumed := 0
+	for i, lvl := range levels {
+		span := totalHours - consumed
+		if lvl.SpanDays > 0 && lvl.SpanDays*24 < span {
+			span = lvl.SpanDays * 24
+		}
+		if span < 0 {
+			span = 0
+		}
+		bucketCounts[i] = (span + lvl.BucketHours - 1) / lvl.BucketHours
+		consumed += span
+	}
+
+	y := 0
+	for _, c := range bucketCounts {
+		y += c
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, x, y))
+	log.Printf("Generating %dx%d composite uptime image across %d resolution bands.\n", x, y, len(levels))
+
+	for col := range uptimes.Fingerprints {
+		agg := aggregated[col]
+		group, highlighted := (*highlight)[col]
+
+		row := 0
+		for li, lvl := range levels {
+			start := uptimestore.LevelStartHours(levels, li)
+			for k := 0; k < bucketCounts[li]; k++ {
+				t := now.Add(-time.Duration(start+k*lvl.BucketHours) * time.Hour)
+				value := agg.BucketAt(t)
+				if highlighted {
+					img.Set(col, row, groupShade(group, value, lvl.BucketHours))
+				} else {
+					img.Set(col, row, bucketColor(value, lvl.BucketHours))
+				}
+				row++
+			}
+		}
+	}
+
+	fd, err := os.Create(fileName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = jpeg.Encode(fd, img, &jpeg.Options{Quality: 100})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Wrote composite image file to: %s\n", fileName)
+}
+
+// bucketColor shades a bucket's value: black/white for the hourly band,
+// where the value is a plain online/offline bit, and a greyscale shade
+// proportional to the fraction of the bucket spent online for coarser
+// bands.
+func bucketColor(value uint8, bucketHours int) color.RGBA {
+
+	if bucketHours <= 1 {
+		if value > 0 {
+			return color.RGBA{0, 0, 0, 255}
+		}
+		return color.RGBA{255, 255, 255, 255}
+	}
+
+	frac := float64(value) / float64(bucketHours)
+	shade := uint8(255 - frac*255)
+
+	return color.RGBA{shade, shade, shade, 255}
+}
+
+// groupShade is bucketColor's highlighted counterpart: instead of shading
+// towards black, it shades towards the column's groupColor, so a
+// highlighted run or cohort stays visually tagged with its colour even in
+// the composite view's coarser, greyscale-like bands.
+func groupShade(group uptimestore.GroupID, value uint8, bucketHours int) color.RGBA {
+
+	if bucketHours <= 1 {
+		if value > 0 {
+			return groupColor(group)
+		}
+		return color.RGBA{255, 255, 255, 255}
+	}
+
+	frac := float64(value) / float64(bucketHours)
+	base := groupColor(group)
+
+	shade := func(c uint8) uint8 {
+		return uint8(255 - frac*(255-float64(c)))
+	}
+
+	return color.RGBA{shade(base.R), shade(base.G), shade(base.B), 255}
+}
+
+// groupColor picks a distinct hue per GroupID, cycling through the colour
+// wheel, so dispersed Sybil cohorts found by GroupBySimilarity are visually
+// distinguishable from one another rather than all sharing a single red.
+func groupColor(group uptimestore.GroupID) color.RGBA {
+
+	const goldenAngle = 0.618033988749895
+
+	hue := math.Mod(float64(group)*goldenAngle, 1)
+	return hsvToRGB(hue, 0.85, 0.95)
+}
+
+// hsvToRGB converts an HSV triple (each in [0, 1]) to an opaque RGBA color.
+func hsvToRGB(h, s, v float64) color.RGBA {
+
+	i := int(h * 6)
+	f := h*6 - float64(i)
+	p := v * (1 - s)
+	q := v * (1 - f*s)
+	t := v * (1 - (1-f)*s)
+
+	var r, g, b float64
+	switch i % 6 {
+	case 0:
+		r, g, b = v, t, p
+	case 1:
+		r, g, b = q, v, p
+	case 2:
+		r, g, b = p, v, t
+	case 3:
+		r, g, b = p, q, v
+	case 4:
+		r, g, b = t, p, v
+	default:
+		r, g, b = v, p, q
+	}
+
+	return color.RGBA{uint8(r * 255), uint8(g * 255), uint8(b * 255), 255}
+}
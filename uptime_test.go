@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/NullHypothesis/sybilhunter/uptimestore"
+
+	tor "git.torproject.org/user/phw/zoossh.git"
+)
+
+// TestSortUptimesMatchesSequentialBaseline checks that SortUptimes's
+// sharded, parallel-merge sort produces exactly the same column order as a
+// plain sequential sort.Sort over the same data.
+func TestSortUptimesMatchesSequentialBaseline(t *testing.T) {
+
+	store, err := uptimestore.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Open failed: %s", err)
+	}
+
+	// Give each relay a distinct, well-separated total uptime (multiples of
+	// 24 hours) so ties never come down to comparator-order-dependent
+	// median tie-breaking.
+	const numRelays = 30
+	for i := 1; i <= numRelays; i++ {
+		fpr := tor.Fingerprint(fmt.Sprintf("FPR%037d", i))
+		for day := 0; day < i; day++ {
+			for hour := 0; hour < 24; hour++ {
+				if err := store.MarkOnline(fpr, day, uint(hour)); err != nil {
+					t.Fatalf("MarkOnline failed: %s", err)
+				}
+			}
+		}
+	}
+	if err := store.Tick(numRelays - 1); err != nil {
+		t.Fatalf("Tick failed: %s", err)
+	}
+
+	got := SortUptimes(store)
+
+	want := &OrderedUptimes{Store: store, Fingerprints: store.Fingerprints()}
+	want.precompute()
+	sort.Sort(want)
+
+	if len(got.Fingerprints) != len(want.Fingerprints) {
+		t.Fatalf("got %d fingerprints, want %d", len(got.Fingerprints), len(want.Fingerprints))
+	}
+	for i := range want.Fingerprints {
+		if got.Fingerprints[i] != want.Fingerprints[i] {
+			t.Errorf("position %d: got %s, want %s", i, got.Fingerprints[i], want.Fingerprints[i])
+		}
+		if got.totalUptime[i] != want.totalUptime[i] {
+			t.Errorf("position %d: totalUptime got %d, want %d", i, got.totalUptime[i], want.totalUptime[i])
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package uptimestore
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+
+	tor "git.torproject.org/user/phw/zoossh.git"
+)
+
+// GroupID identifies a cluster of relays whose uptime sequences are
+// suspiciously similar, as found by GroupBySimilarity.  Group IDs are only
+// meaningful within a single call; they carry no meaning across runs.
+type GroupID int
+
+// LSHParams configures the locality-sensitive-hashing pass GroupBySimilarity
+// uses to find similar relays that GetHighlights's adjacent-column scan
+// would otherwise miss.
+type LSHParams struct {
+	// SignatureBits is k, the total number of random-hyperplane bits each
+	// relay's SimHash signature is made of.
+	SignatureBits int
+
+	// NumBands is B, the number of equal-sized bands the signature is
+	// sliced into.  Must evenly divide SignatureBits.
+	NumBands int
+
+	// MinBands is b, the minimum number of bands two relays must share
+	// identical values in before they're verified as a candidate pair.
+	MinBands int
+
+	// MaxDistance is the uptime distance below which a verified candidate
+	// pair is actually grouped together.
+	MaxDistance float32
+
+	// Seed selects the pseudo-random hyperplanes used to build SimHash
+	// signatures.  The same seed must be used for every relay compared in
+	// a single GroupBySimilarity call.
+	Seed int64
+}
+
+// DefaultLSHParams returns sybilhunter's default locality-sensitive-hashing
+// parameters.
+func DefaultLSHParams() LSHParams {
+
+	return LSHParams{
+		SignatureBits: 32,
+		NumBands:      8,
+		MinBands:      2,
+		MaxDistance:   MaxDistanceDefault,
+		Seed:          1,
+	}
+}
+
+// MaxDistanceDefault mirrors the uptime-distance threshold sybilhunter has
+// used since its adjacent-column highlighting was introduced.  uptime.go and
+// the curation package both fall back to it rather than each keeping their
+// own copy of the same literal.
+const MaxDistanceDefault = 0.0002
+
+// hyperplaneSign derives a pseudo-random +1/-1 sign for the given
+// (seed, plane, bit) triple, standing in for a dense random hyperplane
+// matrix so SimHash never has to materialise one.
+func hyperplaneSign(seed int64, plane, bit int) float64 {
+
+	h := fnv.New64a()
+	binary.Write(h, binary.LittleEndian, seed)
+	binary.Write(h, binary.LittleEndian, int64(plane))
+	binary.Write(h, binary.LittleEndian, int64(bit))
+
+	if h.Sum64()%2 == 0 {
+		return 1
+	}
+	return -1
+}
+
+// SimHash computes a k-bit locality-sensitive signature for seq by
+// projecting its online/offline bit vector onto k pseudo-random
+// hyperplanes: bit i of the signature is 1 if seq's projection onto
+// hyperplane i is non-negative.  Similar bit vectors produce signatures
+// that agree in most bits.
+func SimHash(seq OnlineSequence, seed int64, k int) uint64 {
+
+	totalBits := len(seq) * 24
+
+	var signature uint64
+	for plane := 0; plane < k; plane++ {
+		var sum float64
+		for bit := 0; bit < totalBits; bit++ {
+			dayIdx := bit / 24
+			hour := uint32(bit % 24)
+
+			v := -1.0
+			if seq[dayIdx].IsOnline(hour) {
+				v = 1.0
+			}
+			sum += v * hyperplaneSign(seed, plane, bit)
+		}
+		if sum >= 0 {
+			signature |= 1 << uint(plane)
+		}
+	}
+
+	return signature
+}
+
+// bands slices a signature into numBands equal-width bands of bandBits bits
+// each.
+func bands(signature uint64, numBands, bandBits int) []uint64 {
+
+	mask := uint64(1)<<uint(bandBits) - 1
+	out := make([]uint64, numBands)
+	for i := range out {
+		out[i] = (signature >> uint(i*bandBits)) & mask
+	}
+	return out
+}
+
+type bandKey struct {
+	band  int
+	value uint64
+}
+
+type fingerprintPair struct {
+	a, b tor.Fingerprint
+}
+
+func makePair(x, y tor.Fingerprint) fingerprintPair {
+
+	if x < y {
+		return fingerprintPair{a: x, b: y}
+	}
+	return fingerprintPair{a: y, b: x}
+}
+
+// GroupBySimilarity finds clusters of relays whose uptime sequences are
+// similar, even when the sort order in OrderedUptimes places them far
+// apart: every relay's sequence is reduced to a SimHash signature, banded
+// into buckets, and any pair sharing at least MinBands identical bands is
+// verified with UptimeDistance before being grouped.
+func GroupBySimilarity(store *SeriesStore, params LSHParams) (map[tor.Fingerprint]GroupID, error) {
+
+	bandBits := params.SignatureBits / params.NumBands
+
+	fprs := store.Fingerprints()
+	signatures := make(map[tor.Fingerprint]uint64, len(fprs))
+
+	for _, fpr := range fprs {
+		seq, err := store.Sequence(fpr)
+		if err != nil {
+			return nil, err
+		}
+		signatures[fpr] = SimHash(seq, params.Seed, params.SignatureBits)
+	}
+
+	buckets := make(map[bandKey][]tor.Fingerprint)
+	for _, fpr := range fprs {
+		for i, value := range bands(signatures[fpr], params.NumBands, bandBits) {
+			key := bandKey{band: i, value: value}
+			buckets[key] = append(buckets[key], fpr)
+		}
+	}
+
+	votes := make(map[fingerprintPair]int)
+	for _, members := range buckets {
+		for i := 0; i < len(members); i++ {
+			for j := i + 1; j < len(members); j++ {
+				votes[makePair(members[i], members[j])]++
+			}
+		}
+	}
+
+	groups := make(map[tor.Fingerprint]GroupID)
+	var nextGroup GroupID = 1
+
+	for pair, shared := range votes {
+		if shared < params.MinBands {
+			continue
+		}
+
+		distance, err := store.UptimeDistance(pair.a, pair.b)
+		if err != nil || distance >= params.MaxDistance {
+			continue
+		}
+
+		groupA, hasA := groups[pair.a]
+		groupB, hasB := groups[pair.b]
+
+		switch {
+		case hasA && hasB:
+			if groupA != groupB {
+				for fpr, g := range groups {
+					if g == groupB {
+						groups[fpr] = groupA
+					}
+				}
+			}
+		case hasA:
+			groups[pair.b] = groupA
+		case hasB:
+			groups[pair.a] = groupB
+		default:
+			groups[pair.a] = nextGroup
+			groups[pair.b] = nextGroup
+			nextGroup++
+		}
+	}
+
+	return groups, nil
+}
@@ -0,0 +1,85 @@
+package uptimestore
+
+import (
+	"testing"
+
+	tor "git.torproject.org/user/phw/zoossh.git"
+)
+
+// TestGroupBySimilarityFindsDispersedPair checks that GroupBySimilarity
+// groups two relays with near-identical uptime sequences purely from their
+// SimHash signatures, with no help from fingerprint order or adjacency --
+// exactly the case GetHighlights's adjacent-column scan misses and
+// GroupBySimilarity exists to catch.
+func TestGroupBySimilarityFindsDispersedPair(t *testing.T) {
+
+	store, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Open failed: %s", err)
+	}
+
+	const numDays = 10
+
+	// cohortA and cohortB share the same online/offline pattern, but their
+	// fingerprints sort at opposite ends of the relay list.
+	cohortA := tor.Fingerprint("AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA")
+	cohortB := tor.Fingerprint("ZZZZZZZZZZZZZZZZZZZZZZZZZZZZZZZZZZZZZZZZ")
+
+	// A handful of unrelated relays, alternating fingerprints so they sort
+	// between cohortA and cohortB, each with a distinct online pattern.
+	others := []tor.Fingerprint{
+		"BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB",
+		"MMMMMMMMMMMMMMMMMMMMMMMMMMMMMMMMMMMMMMMM",
+		"YYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYY",
+	}
+
+	for day := 0; day < numDays; day++ {
+		for hour := 0; hour < 24; hour++ {
+			if (day+hour)%3 != 0 {
+				if err := store.MarkOnline(cohortA, day, uint(hour)); err != nil {
+					t.Fatalf("MarkOnline(cohortA) failed: %s", err)
+				}
+				if err := store.MarkOnline(cohortB, day, uint(hour)); err != nil {
+					t.Fatalf("MarkOnline(cohortB) failed: %s", err)
+				}
+			}
+		}
+	}
+
+	for i, fpr := range others {
+		for day := 0; day < numDays; day++ {
+			for hour := 0; hour < 24; hour++ {
+				if (day+hour)%(2+i) == 0 {
+					if err := store.MarkOnline(fpr, day, uint(hour)); err != nil {
+						t.Fatalf("MarkOnline(%s) failed: %s", fpr, err)
+					}
+				}
+			}
+		}
+	}
+
+	if err := store.Tick(numDays - 1); err != nil {
+		t.Fatalf("Tick failed: %s", err)
+	}
+
+	params := DefaultLSHParams()
+	groups, err := GroupBySimilarity(store, params)
+	if err != nil {
+		t.Fatalf("GroupBySimilarity failed: %s", err)
+	}
+
+	groupA, hasA := groups[cohortA]
+	groupB, hasB := groups[cohortB]
+	if !hasA || !hasB {
+		t.Fatalf("cohortA and cohortB were not grouped at all: %+v", groups)
+	}
+	if groupA != groupB {
+		t.Errorf("cohortA and cohortB landed in different groups: %d != %d", groupA, groupB)
+	}
+
+	for _, fpr := range others {
+		if group, ok := groups[fpr]; ok && group == groupA {
+			t.Errorf("unrelated relay %s was grouped with cohortA/cohortB", fpr)
+		}
+	}
+}
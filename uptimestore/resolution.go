@@ -0,0 +1,221 @@
+package uptimestore
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resolution describes one band of a multi-resolution uptime view: how many
+// hours are folded into a single bucket, and how many days back the band
+// reaches before handing off to the next, coarser band.  A SpanDays of 0
+// means "the rest of history", and is only valid for the last, coarsest
+// band in a set of Levels.
+type Resolution struct {
+	Name        string
+	BucketHours int
+	SpanDays    int
+}
+
+// ParseResolutions parses a --resolutions flag value such as
+// "1h:7d,1d:60d,1w:all" into an ordered list of Resolution bands, finest and
+// most recent first.
+func ParseResolutions(spec string) ([]Resolution, error) {
+
+	var levels []Resolution
+
+	for _, part := range strings.Split(spec, ",") {
+		fields := strings.SplitN(part, ":", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("malformed resolution %q, want <bucket>:<span>\n", part)
+		}
+
+		bucketHours, err := parseBucketGranularity(fields[0])
+		if err != nil {
+			return nil, err
+		}
+
+		spanDays, err := parseSpan(fields[1])
+		if err != nil {
+			return nil, err
+		}
+
+		levels = append(levels, Resolution{Name: fields[0], BucketHours: bucketHours, SpanDays: spanDays})
+	}
+
+	return levels, nil
+}
+
+func parseBucketGranularity(s string) (int, error) {
+
+	switch s {
+	case "1h":
+		return 1, nil
+	case "1d":
+		return 24, nil
+	case "1w":
+		return 24 * 7, nil
+	}
+
+	return 0, fmt.Errorf("unsupported resolution bucket %q\n", s)
+}
+
+func parseSpan(s string) (int, error) {
+
+	if s == "all" {
+		return 0, nil
+	}
+	if !strings.HasSuffix(s, "d") {
+		return 0, fmt.Errorf("unsupported resolution span %q, want e.g. \"60d\" or \"all\"\n", s)
+	}
+
+	days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+	if err != nil {
+		return 0, fmt.Errorf("unsupported resolution span %q: %s\n", s, err)
+	}
+
+	return days, nil
+}
+
+// LevelStartHours returns how many hours before "now" the band at levels[idx]
+// begins, i.e. the sum of every finer band's span preceding it.
+func LevelStartHours(levels []Resolution, idx int) int {
+
+	start := 0
+	for i := 0; i < idx; i++ {
+		start += levels[i].SpanDays * 24
+	}
+	return start
+}
+
+func levelForAge(levels []Resolution, ageHours int) int {
+
+	for i, lvl := range levels {
+		if lvl.SpanDays == 0 {
+			return i
+		}
+		if ageHours < LevelStartHours(levels, i)+lvl.SpanDays*24 {
+			return i
+		}
+	}
+	return len(levels) - 1
+}
+
+// AggregatedSequence keeps high-resolution, per-hour data for recent history
+// and progressively coarser day/week aggregates for older history, so a
+// year-long sequence can be visualised without a 10,000-pixel-tall image.
+type AggregatedSequence struct {
+	now     time.Time
+	levels  []Resolution
+	buckets [][]uint8
+}
+
+// NewAggregatedSequence builds an AggregatedSequence from a relay's full
+// online sequence.  now anchors the sequence's most recent hour, so BucketAt
+// can later be queried with ordinary wall-clock times.
+func NewAggregatedSequence(seq OnlineSequence, now time.Time, levels []Resolution) *AggregatedSequence {
+
+	agg := &AggregatedSequence{
+		now:     now,
+		levels:  levels,
+		buckets: make([][]uint8, len(levels)),
+	}
+
+	totalHours := len(seq) * 24
+
+	for hourOffset := totalHours - 1; hourOffset >= 0; hourOffset-- {
+		age := totalHours - 1 - hourOffset
+
+		li := levelForAge(levels, age)
+		start := LevelStartHours(levels, li)
+		bucketIdx := (age - start) / levels[li].BucketHours
+
+		for len(agg.buckets[li]) <= bucketIdx {
+			agg.buckets[li] = append(agg.buckets[li], 0)
+		}
+
+		dayIdx := hourOffset / 24
+		hour := uint32(hourOffset % 24)
+		if !seq[dayIdx].IsOnline(hour) {
+			continue
+		}
+
+		if levels[li].BucketHours == 1 {
+			agg.buckets[li][bucketIdx] = 1
+		} else {
+			agg.buckets[li][bucketIdx]++
+		}
+	}
+
+	return agg
+}
+
+// Level returns the Resolution band at index i.
+func (a *AggregatedSequence) Level(i int) Resolution {
+
+	return a.levels[i]
+}
+
+// BucketAt returns the online-hours value of the bucket covering t: 0 or 1
+// for an hourly band, and an hour count (0..BucketHours) for coarser bands.
+// It returns 0 for times outside the sequence's recorded history.
+func (a *AggregatedSequence) BucketAt(t time.Time) uint8 {
+
+	age := int(a.now.Sub(t).Hours())
+	if age < 0 {
+		return 0
+	}
+
+	li := levelForAge(a.levels, age)
+	start := LevelStartHours(a.levels, li)
+	bucketIdx := (age - start) / a.levels[li].BucketHours
+
+	if bucketIdx < 0 || bucketIdx >= len(a.buckets[li]) {
+		return 0
+	}
+
+	return a.buckets[li][bucketIdx]
+}
+
+// AggregatedDistance determines the distance between two relays' aggregated
+// sequences, bucket by bucket, the same way UptimeDistance does for raw
+// hourly sequences.  Both sequences must use the same resolution levels.
+func AggregatedDistance(a, b *AggregatedSequence) (float32, error) {
+
+	if len(a.levels) != len(b.levels) {
+		return 0, fmt.Errorf("both aggregated sequences must use the same resolution levels\n")
+	}
+
+	var distance, boost float32
+	var buckets int
+
+	for li := range a.levels {
+		if a.levels[li] != b.levels[li] {
+			return 0, fmt.Errorf("both aggregated sequences must use the same resolution levels\n")
+		}
+
+		n := len(a.buckets[li])
+		if len(b.buckets[li]) < n {
+			n = len(b.buckets[li])
+		}
+
+		for k := 0; k < n; k++ {
+			if a.buckets[li][k] != b.buckets[li][k] {
+				if boost < 1 {
+					boost += 0.1
+				}
+				distance += boost
+			} else {
+				boost = 0
+			}
+			buckets++
+		}
+	}
+
+	if buckets == 0 {
+		return 0, nil
+	}
+
+	return distance / float32(buckets), nil
+}
@@ -0,0 +1,118 @@
+package uptimestore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseResolutions(t *testing.T) {
+
+	levels, err := ParseResolutions("1h:7d,1d:60d,1w:all")
+	if err != nil {
+		t.Fatalf("ParseResolutions failed: %s", err)
+	}
+
+	want := []Resolution{
+		{Name: "1h", BucketHours: 1, SpanDays: 7},
+		{Name: "1d", BucketHours: 24, SpanDays: 60},
+		{Name: "1w", BucketHours: 24 * 7, SpanDays: 0},
+	}
+
+	if len(levels) != len(want) {
+		t.Fatalf("got %d levels, want %d", len(levels), len(want))
+	}
+	for i := range want {
+		if levels[i] != want[i] {
+			t.Errorf("level %d: got %+v, want %+v", i, levels[i], want[i])
+		}
+	}
+}
+
+func TestParseResolutionsRejectsMalformed(t *testing.T) {
+
+	cases := []string{"1h", "1h:", "2h:7d", "1h:7x"}
+
+	for _, spec := range cases {
+		if _, err := ParseResolutions(spec); err == nil {
+			t.Errorf("ParseResolutions(%q) succeeded, want error", spec)
+		}
+	}
+}
+
+func TestLevelStartHours(t *testing.T) {
+
+	levels := []Resolution{
+		{Name: "1h", BucketHours: 1, SpanDays: 7},
+		{Name: "1d", BucketHours: 24, SpanDays: 60},
+		{Name: "1w", BucketHours: 24 * 7, SpanDays: 0},
+	}
+
+	if got := LevelStartHours(levels, 0); got != 0 {
+		t.Errorf("LevelStartHours(0) = %d, want 0", got)
+	}
+	if got := LevelStartHours(levels, 1); got != 7*24 {
+		t.Errorf("LevelStartHours(1) = %d, want %d", got, 7*24)
+	}
+	if got := LevelStartHours(levels, 2); got != (7+60)*24 {
+		t.Errorf("LevelStartHours(2) = %d, want %d", got, (7+60)*24)
+	}
+}
+
+// TestBucketAtCrossesLevelBoundary checks that BucketAt reads the right
+// resolution band on both sides of a level boundary -- an hourly bucket just
+// inside the finest band's span, a daily bucket just past it -- and returns 0
+// for times outside the sequence's recorded history.
+func TestBucketAtCrossesLevelBoundary(t *testing.T) {
+
+	levels := []Resolution{
+		{Name: "1h", BucketHours: 1, SpanDays: 2},
+		{Name: "1d", BucketHours: 24, SpanDays: 0},
+	}
+
+	// 5 days, every hour online except the most recent day, so the finest
+	// band's newest bucket and the first daily bucket land on opposite
+	// sides of an all-online/all-offline boundary and aren't easily
+	// confused with each other.
+	seq := make(OnlineSequence, 5)
+	for d := range seq {
+		var day Day
+		if d != 4 {
+			for hour := uint(0); hour < 24; hour++ {
+				day.MarkOnline(hour)
+			}
+		}
+		seq[d] = day
+	}
+
+	epoch := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := epoch.Add(119 * time.Hour) // day 4, hour 23: the sequence's last hour.
+
+	agg := NewAggregatedSequence(seq, now, levels)
+
+	// Newest hour (day 4, offline) sits in the finest band.
+	if got := agg.BucketAt(now); got != 0 {
+		t.Errorf("BucketAt(now) = %d, want 0", got)
+	}
+
+	// One hour before the finest band's span ends (day 3, hour 0, online)
+	// still resolves to the hourly band.
+	if got := agg.BucketAt(now.Add(-47 * time.Hour)); got != 1 {
+		t.Errorf("BucketAt(now-47h) = %d, want 1", got)
+	}
+
+	// Immediately past the boundary, BucketAt must read the daily band
+	// instead, whose bucket is fully online (day 2, all 24 hours).
+	if got := agg.BucketAt(now.Add(-48 * time.Hour)); got != 24 {
+		t.Errorf("BucketAt(now-48h) = %d, want 24", got)
+	}
+
+	// Before the sequence's recorded history.
+	if got := agg.BucketAt(epoch.Add(-24 * time.Hour)); got != 0 {
+		t.Errorf("BucketAt(before history) = %d, want 0", got)
+	}
+
+	// After now, BucketAt must not wrap into negative ages.
+	if got := agg.BucketAt(now.Add(time.Hour)); got != 0 {
+		t.Errorf("BucketAt(after now) = %d, want 0", got)
+	}
+}
@@ -0,0 +1,90 @@
+// Package uptimestore persists the per-relay uptime sequences used by
+// sybilhunter's uptime visualisation so the tool can process years of
+// consensuses without keeping every relay's bitmap resident in RAM.
+package uptimestore
+
+import (
+	"log"
+	"math"
+	"math/bits"
+)
+
+// Day represents the uptime/downtime pattern of a relay for a single day.
+type Day uint32
+
+// MarkOnline marks a given hour in the day as online, i.e., it sets the bit
+// position to 1.
+func (day *Day) MarkOnline(hour uint) {
+
+	*day = Day(uint32(*day) | (1 << hour))
+}
+
+// IsOnline returns true if the relay was online at the given hour.
+func (day *Day) IsOnline(hour uint32) bool {
+
+	return (uint32(*day) & (1 << hour)) > 0
+}
+
+// OnlineSequence represents a sequence of days.  It is kept small enough to
+// let callers hold a handful of chunks (rather than a relay's entire
+// history) resident at once; see SeriesStore for the on-disk layout.
+type OnlineSequence []Day
+
+// AddDay adds a day to the online sequence.
+func (seq *OnlineSequence) AddDay() {
+
+	*seq = append(*seq, Day(0))
+}
+
+// TotalUptime counts the number of hours, the relay was online.
+func (seq *OnlineSequence) TotalUptime() int {
+
+	total := 0
+	for _, day := range *seq {
+		total += bits.OnesCount32(uint32(day))
+	}
+
+	return total
+}
+
+// Median determines the median of the given online sequence.
+func (seq *OnlineSequence) Median() float32 {
+
+	var hour uint32
+	indices := make([]uint32, 0)
+
+	for i, day := range *seq {
+		for hour = 0; hour < 24; hour++ {
+			if day.IsOnline(hour) {
+				indices = append(indices, uint32(i)+hour)
+			}
+		}
+	}
+
+	return medianOfIndices(indices)
+}
+
+// medianOfIndices determines the median of a list of online hour indices,
+// each of which its callers build as day index plus hour of day.  The list
+// is taken in the order it was built and is not sorted first; for an odd
+// length it returns the element at position ceil(n/2).  It underpins both
+// OnlineSequence.Median, which has
+// the whole sequence resident, and SeriesStore.Median, which assembles the
+// same list one on-disk chunk at a time.
+func medianOfIndices(indices []uint32) float32 {
+
+	indicesLen := len(indices)
+	if indicesLen == 0 {
+		log.Fatalln("Length of indices for calculation of median must not be zero.  Bug?")
+	} else if indicesLen == 1 {
+		return float32(indices[0])
+	}
+
+	if (indicesLen % 2) == 0 {
+		idx := indicesLen / 2
+		return float32(indices[idx-1]+indices[idx]) / 2
+	} else {
+		idx := int(math.Ceil(float64(indicesLen) / 2))
+		return float32(indices[idx])
+	}
+}
@@ -0,0 +1,613 @@
+package uptimestore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	tor "git.torproject.org/user/phw/zoossh.git"
+)
+
+// chunkDays is the number of days held by a single on-disk chunk file.  Once
+// a relay's head chunk holds this many days and its sequence needs another
+// day, the head is flushed to disk and a new, empty head chunk is started.
+const chunkDays = 90
+
+// magic and formatVersion identify the on-disk index file, so a future
+// format change can refuse to load an index it doesn't understand rather
+// than silently misparsing it.
+const (
+	magic         = "SHUT"
+	formatVersion = 1
+)
+
+// seriesMeta tracks the on-disk layout of a single relay's uptime sequence:
+// how many full chunk files have been flushed, and how many days the
+// in-RAM head chunk held the last time the store was closed.
+type seriesMeta struct {
+	NumChunks uint32
+	HeadDays  uint16
+}
+
+// SeriesStore maps relay fingerprints to fixed-size uptime chunk files on
+// disk, plus a fingerprint→offset index, so AnalyseUptimes can ingest years
+// of consensuses while keeping at most one chunk per relay resident in RAM.
+// Older chunks are memory-mapped read-only when a query needs them; the
+// current chunk for each relay is appended to in RAM and flushed once it
+// fills up.
+type SeriesStore struct {
+	dir   string
+	mu    sync.Mutex
+	index map[tor.Fingerprint]*seriesMeta
+	heads map[tor.Fingerprint]OnlineSequence
+}
+
+// Open opens (or creates) a SeriesStore rooted at dir, loading the
+// fingerprint→offset index and any partially-filled head chunks left behind
+// by a previous run.
+func Open(dir string) (*SeriesStore, error) {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("cannot create uptime store directory %s: %s\n", dir, err)
+	}
+
+	store := &SeriesStore{
+		dir:   dir,
+		index: make(map[tor.Fingerprint]*seriesMeta),
+		heads: make(map[tor.Fingerprint]OnlineSequence),
+	}
+
+	if err := store.loadIndex(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (s *SeriesStore) indexPath() string {
+
+	return filepath.Join(s.dir, "index.db")
+}
+
+func (s *SeriesStore) chunkPath(fpr tor.Fingerprint, chunk uint32) string {
+
+	return filepath.Join(s.dir, fmt.Sprintf("%s-%04d.chunk", fpr, chunk))
+}
+
+func (s *SeriesStore) headPath(fpr tor.Fingerprint) string {
+
+	return filepath.Join(s.dir, fmt.Sprintf("%s-head.chunk", fpr))
+}
+
+// loadIndex reads the binary index file, which starts with a magic header
+// and a version byte followed by one entry per known relay (a length-prefixed
+// fingerprint, its chunk count, and its head-chunk day count), and
+// restores any head chunks a previous run left on disk.
+func (s *SeriesStore) loadIndex() error {
+
+	fd, err := os.Open(s.indexPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("cannot open uptime store index: %s\n", err)
+	}
+	defer fd.Close()
+
+	reader := bufio.NewReader(fd)
+	header := make([]byte, len(magic)+1)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return fmt.Errorf("cannot read uptime store index header: %s\n", err)
+	}
+	if string(header[:len(magic)]) != magic {
+		return fmt.Errorf("uptime store index has unexpected magic header\n")
+	}
+	if header[len(magic)] != formatVersion {
+		return fmt.Errorf("uptime store index has unsupported version %d\n", header[len(magic)])
+	}
+
+	for {
+		var fprLen uint16
+		if err := binary.Read(reader, binary.LittleEndian, &fprLen); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return fmt.Errorf("cannot read uptime store index entry: %s\n", err)
+		}
+
+		fprBytes := make([]byte, fprLen)
+		if _, err := io.ReadFull(reader, fprBytes); err != nil {
+			return fmt.Errorf("cannot read uptime store index entry: %s\n", err)
+		}
+		fpr := tor.Fingerprint(fprBytes)
+
+		meta := &seriesMeta{}
+		if err := binary.Read(reader, binary.LittleEndian, &meta.NumChunks); err != nil {
+			return err
+		}
+		if err := binary.Read(reader, binary.LittleEndian, &meta.HeadDays); err != nil {
+			return err
+		}
+		s.index[fpr] = meta
+
+		if meta.HeadDays > 0 {
+			head, err := readSequenceFile(s.headPath(fpr), int(meta.HeadDays))
+			if err != nil {
+				return fmt.Errorf("cannot restore head chunk for %s: %s\n", fpr, err)
+			}
+			s.heads[fpr] = head
+		}
+	}
+
+	return nil
+}
+
+// persistIndex rewrites the index file from the in-memory index.  It is
+// called by Flush and Delete; flushHead leaves it to the next Flush.
+func (s *SeriesStore) persistIndex() error {
+
+	fd, err := os.Create(s.indexPath())
+	if err != nil {
+		return fmt.Errorf("cannot write uptime store index: %s\n", err)
+	}
+	defer fd.Close()
+
+	writer := bufio.NewWriter(fd)
+	writer.WriteString(magic)
+	writer.WriteByte(formatVersion)
+
+	for fpr, meta := range s.index {
+		binary.Write(writer, binary.LittleEndian, uint16(len(fpr)))
+		writer.WriteString(string(fpr))
+		binary.Write(writer, binary.LittleEndian, meta.NumChunks)
+		binary.Write(writer, binary.LittleEndian, meta.HeadDays)
+	}
+
+	return writer.Flush()
+}
+
+func (s *SeriesStore) metaFor(fpr tor.Fingerprint) *seriesMeta {
+
+	meta, exists := s.index[fpr]
+	if !exists {
+		meta = &seriesMeta{}
+		s.index[fpr] = meta
+	}
+	return meta
+}
+
+// MarkOnline records that the relay identified by fpr was online at the
+// given hour of the given (zero-based) day, backfilling any days the relay
+// hasn't been seen for yet.  A head chunk holding chunkDays days is flushed to
+// disk once the relay's sequence grows past it.
+func (s *SeriesStore) MarkOnline(fpr tor.Fingerprint, day int, hour uint) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	meta := s.metaFor(fpr)
+	head, err := s.backfill(fpr, meta, s.heads[fpr], day)
+	if err != nil {
+		return err
+	}
+
+	head[len(head)-1].MarkOnline(hour)
+	s.heads[fpr] = head
+	meta.HeadDays = uint16(len(head))
+
+	return nil
+}
+
+// Tick backfills every relay already known to the store up through day
+// (inclusive), flushing any head chunk that fills up along the way.  The
+// caller invokes it once per day, after MarkOnline has processed that day's
+// consensuses, so relays that drop off the network and stop appearing in
+// consensuses keep pace with relays that are still seen -- mirroring the
+// original in-memory map's Uptimes.AddDay, which advanced every known
+// fingerprint once per day regardless of whether it had been seen.  Without
+// this, a relay's sequence simply stops growing once it goes dark, and
+// UptimeDistance's equal-length requirement makes it invisible to every
+// similarity pass from then on.
+func (s *SeriesStore) Tick(day int) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for fpr, meta := range s.index {
+		head, err := s.backfill(fpr, meta, s.heads[fpr], day)
+		if err != nil {
+			return err
+		}
+		s.heads[fpr] = head
+		meta.HeadDays = uint16(len(head))
+	}
+
+	return nil
+}
+
+// backfill extends head with empty (all-offline) days until fpr's sequence
+// reaches day, flushing a full head chunk to disk before starting the next
+// one, so the returned head always ends with day.  It is the
+// shared growth logic behind both MarkOnline, which backfills a single relay
+// up to the day it was just seen at, and Tick, which backfills every known
+// relay up to a day none of them may have been seen at.
+func (s *SeriesStore) backfill(fpr tor.Fingerprint, meta *seriesMeta, head OnlineSequence, day int) (OnlineSequence, error) {
+
+	for int(meta.NumChunks)*chunkDays+len(head) <= day {
+		if len(head) == chunkDays {
+			if err := s.flushHead(fpr, meta, head); err != nil {
+				return nil, err
+			}
+			head = head[:0]
+		}
+		head = append(head, Day(0))
+	}
+
+	return head, nil
+}
+
+// flushHead appends a full head chunk to its chunk file on disk and bumps
+// the relay's chunk count.  It does not persist the index itself -- callers
+// flush in bulk (SeriesStore.Flush, once per run or curation pass) rather
+// than paying for a full O(numRelays) index rewrite every time a single
+// relay's head chunk happens to fill up.
+func (s *SeriesStore) flushHead(fpr tor.Fingerprint, meta *seriesMeta, head OnlineSequence) error {
+
+	if err := writeSequenceFile(s.chunkPath(fpr, meta.NumChunks), head); err != nil {
+		return fmt.Errorf("cannot flush chunk for %s: %s\n", fpr, err)
+	}
+	meta.NumChunks++
+	meta.HeadDays = 0
+
+	return nil
+}
+
+// Flush writes every relay's partially-filled head chunk to disk and
+// rewrites the index, so a future Open can resume from exactly where this
+// run left off.
+func (s *SeriesStore) Flush() error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for fpr, head := range s.heads {
+		if len(head) == 0 {
+			continue
+		}
+		if err := writeSequenceFile(s.headPath(fpr), head); err != nil {
+			return fmt.Errorf("cannot persist head chunk for %s: %s\n", fpr, err)
+		}
+	}
+
+	return s.persistIndex()
+}
+
+// Delete removes a relay from the store entirely, along with its chunk
+// files.  It's used by PruneUptimes to get rid of relays that are of little
+// analytical interest.
+func (s *SeriesStore) Delete(fpr tor.Fingerprint) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	meta, exists := s.index[fpr]
+	if exists {
+		for c := uint32(0); c < meta.NumChunks; c++ {
+			os.Remove(s.chunkPath(fpr, c))
+		}
+	}
+	os.Remove(s.headPath(fpr))
+
+	delete(s.index, fpr)
+	delete(s.heads, fpr)
+
+	return s.persistIndex()
+}
+
+// Fingerprints returns every relay fingerprint currently known to the store.
+func (s *SeriesStore) Fingerprints() []tor.Fingerprint {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fprs := make([]tor.Fingerprint, 0, len(s.index))
+	for fpr := range s.index {
+		fprs = append(fprs, fpr)
+	}
+	return fprs
+}
+
+// NumRelays returns the number of relays currently tracked by the store.
+func (s *SeriesStore) NumRelays() int {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.index)
+}
+
+// SequenceLength returns the total number of days recorded for fpr, on disk
+// and in the in-RAM head chunk combined.
+func (s *SeriesStore) SequenceLength(fpr tor.Fingerprint) (int, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	meta, exists := s.index[fpr]
+	if !exists {
+		return 0, fmt.Errorf("unknown relay %s\n", fpr)
+	}
+
+	return int(meta.NumChunks)*chunkDays + len(s.heads[fpr]), nil
+}
+
+// readChunk memory-maps a relay's on-disk chunk file read-only and decodes
+// it into an OnlineSequence.  The caller must invoke the returned cleanup
+// function once done with the chunk, which unmaps it again.
+func (s *SeriesStore) readChunk(fpr tor.Fingerprint, chunk uint32) (OnlineSequence, func(), error) {
+
+	path := s.chunkPath(fpr, chunk)
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot open chunk %s: %s\n", path, err)
+	}
+	defer fd.Close()
+
+	info, err := fd.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data, err := syscall.Mmap(int(fd.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot mmap chunk %s: %s\n", path, err)
+	}
+
+	seq := decodeSequence(data)
+	cleanup := func() {
+		syscall.Munmap(data)
+	}
+
+	return seq, cleanup, nil
+}
+
+// Sequence reassembles the full on-disk-plus-head sequence for fpr.  It
+// exists for callers that genuinely need random access across a relay's
+// entire history; TotalUptime, Median, UptimeDistance, and SequenceBand
+// should be preferred since they never hold more than a chunk or two in
+// memory at once.
+func (s *SeriesStore) Sequence(fpr tor.Fingerprint) (OnlineSequence, error) {
+
+	length, err := s.SequenceLength(fpr)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.SequenceBand(fpr, 0, length)
+}
+
+// SequenceBand returns the days [startDay, startDay+numDays) for fpr,
+// touching only the on-disk chunks (or the in-RAM head) that overlap the
+// requested range.  GenImage uses this to render the output image in
+// row-bands instead of holding every relay's full history in memory.
+func (s *SeriesStore) SequenceBand(fpr tor.Fingerprint, startDay, numDays int) (OnlineSequence, error) {
+
+	s.mu.Lock()
+	meta, exists := s.index[fpr]
+	head := s.heads[fpr]
+	s.mu.Unlock()
+
+	if !exists {
+		return nil, fmt.Errorf("unknown relay %s\n", fpr)
+	}
+
+	band := make(OnlineSequence, 0, numDays)
+	endDay := startDay + numDays
+
+	for day := startDay; day < endDay; {
+		chunk := uint32(day / chunkDays)
+
+		if chunk < meta.NumChunks {
+			seq, cleanup, err := s.readChunk(fpr, chunk)
+			if err != nil {
+				return nil, err
+			}
+			within := day % chunkDays
+			upto := chunkDays
+			if remaining := endDay - int(chunk)*chunkDays; remaining < upto {
+				upto = remaining
+			}
+			band = append(band, seq[within:upto]...)
+			day += upto - within
+			cleanup()
+			continue
+		}
+
+		headIdx := day - int(meta.NumChunks)*chunkDays
+		if headIdx < len(head) {
+			upto := len(head)
+			if remaining := endDay - int(meta.NumChunks)*chunkDays; remaining < upto {
+				upto = remaining
+			}
+			band = append(band, head[headIdx:upto]...)
+			day += upto - headIdx
+			continue
+		}
+
+		band = append(band, Day(0))
+		day++
+	}
+
+	return band, nil
+}
+
+// TotalUptime sums the online hours across every on-disk chunk plus the
+// in-RAM head chunk for fpr, mapping in at most one chunk at a time.
+func (s *SeriesStore) TotalUptime(fpr tor.Fingerprint) (int, error) {
+
+	s.mu.Lock()
+	meta, exists := s.index[fpr]
+	head := s.heads[fpr]
+	s.mu.Unlock()
+
+	if !exists {
+		return 0, fmt.Errorf("unknown relay %s\n", fpr)
+	}
+
+	total := 0
+	for c := uint32(0); c < meta.NumChunks; c++ {
+		chunk, cleanup, err := s.readChunk(fpr, c)
+		if err != nil {
+			return 0, err
+		}
+		total += chunk.TotalUptime()
+		cleanup()
+	}
+	total += head.TotalUptime()
+
+	return total, nil
+}
+
+// Median determines the median of fpr's online-hour indices, assembling the
+// list one on-disk chunk at a time.  Each index is the same day-plus-hour
+// value OnlineSequence.Median uses; see medianOfIndices.
+func (s *SeriesStore) Median(fpr tor.Fingerprint) (float32, error) {
+
+	s.mu.Lock()
+	meta, exists := s.index[fpr]
+	head := s.heads[fpr]
+	s.mu.Unlock()
+
+	if !exists {
+		return 0, fmt.Errorf("unknown relay %s\n", fpr)
+	}
+
+	indices := make([]uint32, 0)
+	offset := uint32(0)
+
+	collect := func(seq OnlineSequence) {
+		var hour uint32
+		for i, day := range seq {
+			for hour = 0; hour < 24; hour++ {
+				if day.IsOnline(hour) {
+					indices = append(indices, offset+uint32(i)+hour)
+				}
+			}
+		}
+		offset += uint32(len(seq))
+	}
+
+	for c := uint32(0); c < meta.NumChunks; c++ {
+		chunk, cleanup, err := s.readChunk(fpr, c)
+		if err != nil {
+			return 0, err
+		}
+		collect(chunk)
+		cleanup()
+	}
+	collect(head)
+
+	return medianOfIndices(indices), nil
+}
+
+// UptimeDistance determines the distance between two relays' online
+// sequences, mapping in at most one chunk per relay at a time.
+func (s *SeriesStore) UptimeDistance(fpr1, fpr2 tor.Fingerprint) (float32, error) {
+
+	s.mu.Lock()
+	meta1, exists1 := s.index[fpr1]
+	meta2, exists2 := s.index[fpr2]
+	head1 := s.heads[fpr1]
+	head2 := s.heads[fpr2]
+	s.mu.Unlock()
+
+	if !exists1 || !exists2 {
+		return 0, fmt.Errorf("unknown relay\n")
+	}
+	if meta1.NumChunks != meta2.NumChunks || len(head1) != len(head2) {
+		return 0, fmt.Errorf("Both sequences must have same length.\n")
+	}
+
+	var distance, boost float32
+	var days int
+
+	compare := func(seq1, seq2 OnlineSequence) {
+		var hour uint32
+		for day := range seq1 {
+			for hour = 0; hour < 24; hour++ {
+				status1 := seq1[day].IsOnline(hour)
+				status2 := seq2[day].IsOnline(hour)
+
+				if status1 != status2 {
+					if boost < 1 {
+						boost += 0.1
+					}
+					distance += boost
+				} else {
+					boost = 0
+				}
+			}
+			days++
+		}
+	}
+
+	for c := uint32(0); c < meta1.NumChunks; c++ {
+		chunk1, cleanup1, err := s.readChunk(fpr1, c)
+		if err != nil {
+			return 0, err
+		}
+		chunk2, cleanup2, err := s.readChunk(fpr2, c)
+		if err != nil {
+			cleanup1()
+			return 0, err
+		}
+		compare(chunk1, chunk2)
+		cleanup1()
+		cleanup2()
+	}
+	compare(head1, head2)
+
+	return distance / float32(days*24), nil
+}
+
+// decodeSequence decodes a chunk file's raw bytes into an OnlineSequence,
+// one little-endian uint32 per day.
+func decodeSequence(data []byte) OnlineSequence {
+
+	seq := make(OnlineSequence, len(data)/4)
+	for i := range seq {
+		seq[i] = Day(binary.LittleEndian.Uint32(data[i*4 : i*4+4]))
+	}
+	return seq
+}
+
+// writeSequenceFile writes seq to path as a flat array of little-endian
+// uint32s, one per day.
+func writeSequenceFile(path string, seq OnlineSequence) error {
+
+	buf := make([]byte, len(seq)*4)
+	for i, day := range seq {
+		binary.LittleEndian.PutUint32(buf[i*4:i*4+4], uint32(day))
+	}
+
+	return os.WriteFile(path, buf, 0644)
+}
+
+// readSequenceFile reads a flat array of little-endian uint32s back into an
+// OnlineSequence of the given length.
+func readSequenceFile(path string, days int) (OnlineSequence, error) {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != days*4 {
+		return nil, fmt.Errorf("sequence file %s has unexpected size %d (wanted %d)\n", path, len(data), days*4)
+	}
+
+	return decodeSequence(data), nil
+}
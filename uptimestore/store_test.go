@@ -0,0 +1,85 @@
+package uptimestore
+
+import (
+	"testing"
+
+	tor "git.torproject.org/user/phw/zoossh.git"
+)
+
+func TestSequenceFileRoundTrip(t *testing.T) {
+
+	dir := t.TempDir()
+	path := dir + "/seq.chunk"
+
+	want := OnlineSequence{Day(0), Day(1), Day(0xffffffff), Day(42)}
+	if err := writeSequenceFile(path, want); err != nil {
+		t.Fatalf("writeSequenceFile failed: %s", err)
+	}
+
+	got, err := readSequenceFile(path, len(want))
+	if err != nil {
+		t.Fatalf("readSequenceFile failed: %s", err)
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("got %d days, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("day %d: got %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+// TestTickBackfillsUnseenRelays verifies that Tick advances every known
+// relay's sequence length, not just the ones MarkOnline touched that day --
+// the bug that made relays which drop off the network permanently invisible
+// to UptimeDistance's equal-length check.
+func TestTickBackfillsUnseenRelays(t *testing.T) {
+
+	store, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Open failed: %s", err)
+	}
+
+	active := tor.Fingerprint("ACTIVE0000000000000000000000000000000000")
+	churned := tor.Fingerprint("CHURNED000000000000000000000000000000000")
+
+	if err := store.MarkOnline(active, 0, 0); err != nil {
+		t.Fatalf("MarkOnline(active) failed: %s", err)
+	}
+	if err := store.MarkOnline(churned, 0, 0); err != nil {
+		t.Fatalf("MarkOnline(churned) failed: %s", err)
+	}
+	if err := store.Tick(0); err != nil {
+		t.Fatalf("Tick(0) failed: %s", err)
+	}
+
+	// churned never appears again, but active keeps being seen for a few
+	// more days.
+	for day := 1; day <= 3; day++ {
+		if err := store.MarkOnline(active, day, 0); err != nil {
+			t.Fatalf("MarkOnline(active, %d) failed: %s", day, err)
+		}
+		if err := store.Tick(day); err != nil {
+			t.Fatalf("Tick(%d) failed: %s", day, err)
+		}
+	}
+
+	activeLen, err := store.SequenceLength(active)
+	if err != nil {
+		t.Fatalf("SequenceLength(active) failed: %s", err)
+	}
+	churnedLen, err := store.SequenceLength(churned)
+	if err != nil {
+		t.Fatalf("SequenceLength(churned) failed: %s", err)
+	}
+
+	if activeLen != churnedLen {
+		t.Fatalf("sequence lengths diverged: active=%d, churned=%d", activeLen, churnedLen)
+	}
+
+	if _, err := store.UptimeDistance(active, churned); err != nil {
+		t.Fatalf("UptimeDistance failed after Tick kept lengths in sync: %s", err)
+	}
+}